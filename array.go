@@ -0,0 +1,381 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// arrayVars holds the indexed array variables. Arrays are dense: setting an
+// element past the end fills the gap with empty strings.
+var arrayVars = make(map[string][]string)
+
+// assocVars holds the associative arrays, which declare -A creates.
+var assocVars = make(map[string]map[string]string)
+
+// arrayAssign is a name=(word...) assignment of a whole array.
+type arrayAssign struct {
+	name   string
+	values []string
+}
+
+// splitSubscript splits a reference of the form name[sub]. ok is false if
+// ref is not one.
+func splitSubscript(ref string) (name, sub string, ok bool) {
+	open := strings.IndexByte(ref, '[')
+	if open <= 0 || !strings.HasSuffix(ref, "]") {
+		return "", "", false
+	}
+	name, sub = ref[:open], ref[open+1:len(ref)-1]
+	return name, sub, isValidName(name)
+}
+
+// isAssignable reports whether lhs can be assigned to: a variable name or
+// an array element. Only the subscript of an element may have been quoted.
+func isAssignable(lhs string, quoted bool) bool {
+	if _, _, ok := splitSubscript(lhs); ok {
+		return true
+	}
+	return !quoted && isValidName(lhs)
+}
+
+// arrayIndex parses the subscript of an array of the given length.
+// Negative subscripts count back from the end.
+func arrayIndex(sub string, length int) (int, error) {
+	i, err := strconv.Atoi(strings.TrimSpace(sub))
+	if err == nil && i < 0 {
+		i += length
+	}
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%s: bad array subscript", sub)
+	}
+	return i, nil
+}
+
+// setArray replaces a variable with an array of values.
+func setArray(name string, values []string) {
+	unsetVar(name)
+	arrayVars[name] = values
+}
+
+// setAssoc replaces a variable with an associative array made from words
+// of the form [key]=value.
+func setAssoc(name string, words []string) error {
+	m := make(map[string]string)
+	for _, word := range words {
+		key, value, ok := strings.Cut(word, "]=")
+		if !ok || !strings.HasPrefix(key, "[") {
+			return fmt.Errorf("%s: %s: must use subscript when assigning associative array", name, word)
+		}
+		m[key[1:]] = value
+	}
+
+	unsetVar(name)
+	assocVars[name] = m
+	return nil
+}
+
+// setElement sets one element of an array. A scalar variable becomes an
+// indexed array with its value as element 0.
+func setElement(name, sub, value string) error {
+	if m, ok := assocVars[name]; ok {
+		m[sub] = value
+		return nil
+	}
+
+	arr, ok := arrayVars[name]
+	if !ok {
+		if v, isSet := findVar(name); isSet {
+			arr = []string{v}
+		}
+	}
+
+	i, err := arrayIndex(sub, len(arr))
+	if err != nil {
+		return err
+	}
+	for len(arr) <= i {
+		arr = append(arr, "")
+	}
+	arr[i] = value
+
+	setArray(name, arr)
+	return nil
+}
+
+// arrayValues returns the elements of a variable: all of an array's, a
+// scalar's value alone, or none if it is unset.
+func arrayValues(name string) []string {
+	if arr, ok := arrayVars[name]; ok {
+		return arr
+	}
+	if m, ok := assocVars[name]; ok {
+		values := make([]string, 0, len(m))
+		for _, key := range arrayKeys(name) {
+			values = append(values, m[key])
+		}
+		return values
+	}
+	if v, ok := findVar(name); ok {
+		return []string{v}
+	}
+	return nil
+}
+
+// arrayKeys returns the subscripts of a variable's elements, which for an
+// associative array are its keys in sorted order.
+func arrayKeys(name string) []string {
+	if m, ok := assocVars[name]; ok {
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	keys := make([]string, len(arrayValues(name)))
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	return keys
+}
+
+// arrayElement returns the element of a variable with subscript sub.
+func arrayElement(name, sub string) string {
+	if m, ok := assocVars[name]; ok {
+		return m[sub]
+	}
+
+	values := arrayValues(name)
+	i, err := arrayIndex(sub, len(values))
+	if err != nil || i >= len(values) {
+		return ""
+	}
+	return values[i]
+}
+
+// assign performs a NAME=value or NAME[sub]=value assignment word.
+func assign(word string) error {
+	lhs, value, _ := strings.Cut(word, "=")
+	if name, sub, ok := splitSubscript(lhs); ok {
+		return setElement(name, sub, value)
+	}
+	setVar(lhs, value)
+	return nil
+}
+
+// expandBraced expands the text between ${ and }: a variable, an array
+// element name[sub], all elements with name[@] or name[*], their
+// subscripts with !name[@], the names of the variables that start with a
+// prefix with !prefix* or !prefix@, the parameter named by the value of
+// another with !name, or a length with a leading #, which for name[@] is
+// the number of elements. The subscript is expanded first.
+func (s *Shell) expandBraced(body string) string {
+	if ref, ok := strings.CutPrefix(body, "#"); ok && ref != "" {
+		if name, sub, ok := splitSubscript(ref); ok && (sub == "@" || sub == "*") {
+			return strconv.Itoa(len(arrayValues(name)))
+		}
+		return strconv.Itoa(utf8.RuneCountInString(s.expandBraced(ref)))
+	}
+
+	if ref, ok := strings.CutPrefix(body, "!"); ok {
+		if name, sub, ok := splitSubscript(ref); ok && (sub == "@" || sub == "*") {
+			return strings.Join(arrayKeys(name), " ")
+		}
+		if prefix, ok := strings.CutSuffix(ref, "*"); ok && isValidName(prefix) {
+			return ifsJoin(varNames(prefix))
+		}
+		if prefix, ok := strings.CutSuffix(ref, "@"); ok && isValidName(prefix) {
+			return strings.Join(varNames(prefix), " ")
+		}
+		// Otherwise the value of ref names the parameter to expand
+		if ref != "" {
+			target := s.expandBraced(ref)
+			if !s.isParamRef(target) {
+				debugf("${!%s}: %q is not a parameter name", ref, target)
+				return ""
+			}
+			return s.expandBraced(target)
+		}
+	}
+
+	if value, ok := s.positional(body); ok {
+		return value
+	}
+	if body == "_" {
+		return s.lastArg
+	}
+
+	name, sub, ok := splitSubscript(body)
+	if !ok {
+		return lookupVar(body)
+	}
+	if sub == "@" {
+		return strings.Join(arrayValues(name), " ")
+	}
+	if sub == "*" {
+		return ifsJoin(arrayValues(name))
+	}
+	return arrayElement(name, s.expandText(sub))
+}
+
+// isParamRef reports whether ref names a parameter, as the value of the
+// name in ${!name} must: a variable, an array element or a positional
+// parameter.
+func (s *Shell) isParamRef(ref string) bool {
+	if _, ok := s.positional(ref); ok || isValidName(ref) {
+		return true
+	}
+	_, _, ok := splitSubscript(ref)
+	return ok
+}
+
+// expandWords expands a $@, ${@}, ${name[@]}, ${!name[@]} or ${!prefix@}
+// reference at the start of rest, the text following a '$'. Unlike other
+// expansions it gives one word per element even inside double quotes.
+// Unless quoted is set, the * forms do the same. ok is false if rest does
+// not start with such a reference.
+func (s *Shell) expandWords(rest []rune, quoted bool) (words []string, n int, ok bool) {
+	all := func(sub string) bool {
+		return sub == "@" || sub == "*" && !quoted
+	}
+
+	if len(rest) > 0 && all(string(rest[0])) {
+		return s.params, 1, true
+	}
+	if len(rest) == 0 || rest[0] != '{' {
+		return nil, 0, false
+	}
+	end := 1
+	for end < len(rest) && rest[end] != '}' {
+		end++
+	}
+	if end == len(rest) {
+		return nil, 0, false
+	}
+
+	if all(string(rest[1:end])) {
+		return s.params, end + 1, true
+	}
+	ref, keys := strings.CutPrefix(string(rest[1:end]), "!")
+	if keys && len(ref) > 1 && all(ref[len(ref)-1:]) && isValidName(ref[:len(ref)-1]) {
+		return varNames(ref[:len(ref)-1]), end + 1, true
+	}
+	name, sub, ok := splitSubscript(ref)
+	if !ok || !all(sub) {
+		return nil, 0, false
+	}
+	if keys {
+		return arrayKeys(name), end + 1, true
+	}
+	return arrayValues(name), end + 1, true
+}
+
+// handleDeclare implements `declare [-aAp] [name[=value]...]`. -a makes
+// each name an indexed array and -A an associative one; -p prints the
+// named variables, or all arrays, as declare commands.
+func (s *Shell) handleDeclare(args []string) error {
+	indexed, assoc, print := false, false, false
+	names := args[1:]
+	for len(names) > 0 && len(names[0]) > 1 && names[0][0] == '-' {
+		for _, c := range names[0][1:] {
+			switch c {
+			case 'a':
+				indexed = true
+			case 'A':
+				assoc = true
+			case 'p':
+				print = true
+			default:
+				return invalidOption("declare", "-"+string(c))
+			}
+		}
+		names = names[1:]
+	}
+	if indexed && assoc {
+		return usageError("declare", "cannot use -a and -A together")
+	}
+
+	if print {
+		if len(names) == 0 {
+			for name := range arrayVars {
+				names = append(names, name)
+			}
+			for name := range assocVars {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+		for _, name := range names {
+			if err := s.printDeclaration(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, arg := range names {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !isValidName(name) {
+			return fmt.Errorf("declare: `%s': not a valid identifier", arg)
+		}
+
+		switch {
+		case assoc:
+			if _, ok := assocVars[name]; !ok {
+				if _, ok := arrayVars[name]; ok {
+					return fmt.Errorf("declare: %s: cannot convert indexed to associative array", name)
+				}
+				unsetVar(name)
+				assocVars[name] = make(map[string]string)
+			}
+			if hasValue {
+				assocVars[name]["0"] = value
+			}
+		case indexed:
+			if _, ok := arrayVars[name]; !ok {
+				if _, ok := assocVars[name]; ok {
+					return fmt.Errorf("declare: %s: cannot convert associative to indexed array", name)
+				}
+				setArray(name, arrayValues(name))
+			}
+			if hasValue {
+				setVar(name, value)
+			}
+		case hasValue:
+			setVar(name, value)
+		}
+	}
+
+	return nil
+}
+
+// printDeclaration writes a declare command that recreates a variable.
+func (s *Shell) printDeclaration(name string) error {
+	var elems []string
+	// An array declared without values is in the table, but nil
+	assoc, isAssoc := assocVars[name]
+	values, isArray := arrayVars[name]
+	switch {
+	case isAssoc:
+		for _, key := range arrayKeys(name) {
+			elems = append(elems, fmt.Sprintf("[%s]=%s", shellQuote(key), shellQuote(assoc[key])))
+		}
+		fmt.Fprintf(s.Stdout, "declare -A %s=(%s)\n", name, strings.Join(elems, " "))
+	case isArray:
+		for i, value := range values {
+			elems = append(elems, fmt.Sprintf("[%d]=%s", i, shellQuote(value)))
+		}
+		fmt.Fprintf(s.Stdout, "declare -a %s=(%s)\n", name, strings.Join(elems, " "))
+	default:
+		value, ok := findVar(name)
+		if !ok {
+			return fmt.Errorf("declare: %s: not found", name)
+		}
+		fmt.Fprintf(s.Stdout, "declare -- %s=%s\n", name, shellQuote(value))
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// coprocBase is the lowest descriptor number given to a coprocess pipe,
+// above those scripts usually pick for themselves.
+const coprocBase = 10
+
+// handleCoproc starts a command in the background with pipes to and from
+// it, as bash's coproc does. The shell reads the command's output on the
+// descriptor in ${NAME[0]} and writes to its input on ${NAME[1]}; its pid
+// is in NAME_PID. NAME is COPROC unless a first word that is a name but
+// not a command gives another.
+func (s *Shell) handleCoproc(args []string) error {
+	name := "COPROC"
+	words := args[1:]
+	if len(words) > 1 && isValidName(words[0]) && !isCommand(words[0]) {
+		name, words = words[0], words[1:]
+	}
+	if len(words) == 0 {
+		return usageError("coproc", "")
+	}
+
+	path, err := exec.LookPath(words[0])
+	if err != nil {
+		return notFoundError(words[0])
+	}
+
+	// toCmd carries what the shell writes to the command's input, and
+	// fromCmd the command's output back to the shell
+	toR, toW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("coproc: %w", err)
+	}
+	fromR, fromW, err := os.Pipe()
+	if err != nil {
+		toR.Close()
+		toW.Close()
+		return fmt.Errorf("coproc: %w", err)
+	}
+
+	cmd := exec.Command(path, words[1:]...)
+	table := s.fds()
+	table.stdin, table.stdout = toR, fromW
+	table.setup(cmd)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = cmd.Start()
+	toR.Close()
+	fromW.Close()
+	if err != nil {
+		toW.Close()
+		fromR.Close()
+		return fmt.Errorf("coproc: %w", err)
+	}
+
+	readFd := s.freeFD(coprocBase)
+	s.extraFDs = setFD(s.extraFDs, readFd, fromR)
+	writeFd := s.freeFD(readFd + 1)
+	s.extraFDs = setFD(s.extraFDs, writeFd, toW)
+	setArray(name, []string{strconv.Itoa(readFd), strconv.Itoa(writeFd)})
+	setVar(name+"_PID", strconv.Itoa(cmd.Process.Pid))
+
+	job := newJob([]*exec.Cmd{cmd}, cmd.Process.Pid, "coproc "+name+" "+quoteWords(words))
+	s.coprocs = append(s.coprocs, &coproc{name: name, job: job, fds: map[int]*os.File{readFd: fromR, writeFd: toW}})
+	startReaping(job, true)
+	s.startBackground(job)
+	return nil
+}
+
+// coproc is a coprocess the shell has pipes to, under the descriptors in
+// fds.
+type coproc struct {
+	name string
+	job  *Job
+	fds  map[int]*os.File
+}
+
+// closeCoprocs closes the pipes to the coprocesses that have finished and
+// unsets their variables, as bash does once it has reaped one. A
+// descriptor that has since been made to refer to something else is left
+// alone.
+func (s *Shell) closeCoprocs() {
+	running := s.coprocs[:0]
+	for _, cp := range s.coprocs {
+		if !cp.job.finished() {
+			running = append(running, cp)
+			continue
+		}
+		for fd, file := range cp.fds {
+			if s.extraFDs[fd] == file {
+				file.Close()
+				delete(s.extraFDs, fd)
+			}
+		}
+		unsetVar(cp.name)
+		unsetVar(cp.name + "_PID")
+	}
+	s.coprocs = running
+}
+
+// isCommand reports whether name runs something: a builtin or a program
+// on $PATH.
+func isCommand(name string) bool {
+	if _, ok := builtins[name]; ok {
+		return true
+	}
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// freeFD returns the lowest descriptor number from lowest up that the
+// shell does not have open.
+func (s *Shell) freeFD(lowest int) int {
+	fd := lowest
+	for s.extraFDs[fd] != nil {
+		fd++
+	}
+	return fd
+}
+
+// setFD returns fds with descriptor fd set to file, making the map if
+// there is none yet.
+func setFD(fds map[int]*os.File, fd int, file *os.File) map[int]*os.File {
+	if fds == nil {
+		fds = make(map[int]*os.File)
+	}
+	fds[fd] = file
+	return fds
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// debugLog is set when the shell is started with --debug or with GOSH_DEBUG
+// set to anything but "" or "0". The hot paths then trace what they parse,
+// expand and run to stderr.
+var debugLog *log.Logger
+
+func enableDebug() {
+	debugLog = log.New(os.Stderr, "[debug] ", log.Lmicroseconds)
+}
+
+// debugf logs a trace message if debugging is on, and does nothing
+// otherwise.
+func debugf(format string, a ...any) {
+	if debugLog != nil {
+		debugLog.Printf(format, a...)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// dirStack holds the directories saved by pushd, most recent first. The
+// current directory is the top of the stack as dirs shows it, entry 0,
+// and is not stored here.
+var dirStack []string
+
+// dirEntries returns the whole stack as dirs shows it, the current
+// directory first.
+func dirEntries() []string {
+	cwd, err := logicalDir()
+	if err != nil {
+		cwd = "."
+	}
+	return append([]string{cwd}, dirStack...)
+}
+
+// stackIndex converts a +N or -N argument, counting from the top or the
+// bottom of a stack of n entries, into an index from the top. ok is false
+// if arg is not of that form; an index out of range is an error.
+func stackIndex(name, arg string, n int) (index int, ok bool, err error) {
+	if len(arg) < 2 || arg[0] != '+' && arg[0] != '-' {
+		return 0, false, nil
+	}
+	k, convErr := strconv.Atoi(arg[1:])
+	if convErr != nil || k < 0 {
+		return 0, false, nil
+	}
+	if k >= n {
+		return 0, true, fmt.Errorf("%s: %s: directory stack index out of range", name, arg)
+	}
+	if arg[0] == '-' {
+		k = n - 1 - k
+	}
+	return k, true, nil
+}
+
+// chdirTo changes to a directory from the stack as cd would, so that $PWD
+// and $OLDPWD follow.
+func (s *Shell) chdirTo(dir string) error {
+	return s.handleCD([]string{"cd", dir})
+}
+
+// handlePushd saves the current directory on the stack and changes to dir.
+// Without dir it swaps the top two entries, and with +N or -N it rotates
+// the stack to bring that entry to the top. The new stack is printed.
+func (s *Shell) handlePushd(args []string) error {
+	if len(args) > 2 {
+		return usageError("pushd", "too many arguments")
+	}
+	entries := dirEntries()
+
+	switch {
+	case len(args) == 1:
+		if len(dirStack) == 0 {
+			return errors.New("pushd: no other directory")
+		}
+		if err := s.chdirTo(dirStack[0]); err != nil {
+			return err
+		}
+		dirStack[0] = entries[0]
+	default:
+		n, isIndex, err := stackIndex("pushd", args[1], len(entries))
+		if err != nil {
+			return err
+		}
+		if isIndex {
+			rotated := append(entries[n:], entries[:n]...)
+			if err := s.chdirTo(rotated[0]); err != nil {
+				return err
+			}
+			dirStack = rotated[1:]
+			break
+		}
+		if err := s.chdirTo(args[1]); err != nil {
+			return err
+		}
+		dirStack = append([]string{entries[0]}, dirStack...)
+	}
+
+	return s.printDirs(false, false, false)
+}
+
+// handlePopd removes the top entry from the stack and changes to the one
+// below it. With +N or -N it removes that entry instead, changing
+// directory only if it is the top one.
+func (s *Shell) handlePopd(args []string) error {
+	if len(args) > 2 {
+		return usageError("popd", "too many arguments")
+	}
+	if len(dirStack) == 0 {
+		return errors.New("popd: directory stack empty")
+	}
+
+	n := 0
+	if len(args) == 2 {
+		var isIndex bool
+		var err error
+		n, isIndex, err = stackIndex("popd", args[1], len(dirStack)+1)
+		if err != nil {
+			return err
+		}
+		if !isIndex {
+			return usageError("popd", args[1]+": invalid argument")
+		}
+	}
+
+	if n == 0 {
+		if err := s.chdirTo(dirStack[0]); err != nil {
+			return err
+		}
+		dirStack = dirStack[1:]
+	} else {
+		dirStack = append(dirStack[:n-1:n-1], dirStack[n:]...)
+	}
+
+	return s.printDirs(false, false, false)
+}
+
+// handleDirs prints the directory stack, the current directory first, on
+// one line with $HOME written as ~. -l prints full paths, -p one entry per
+// line and -v one per line with its index; -c clears the stack. +N or -N
+// prints just that entry.
+func (s *Shell) handleDirs(args []string) error {
+	long, perLine, numbered := false, false, false
+	entries := dirEntries()
+
+	for _, arg := range args[1:] {
+		if n, isIndex, err := stackIndex("dirs", arg, len(entries)); isIndex {
+			if err != nil {
+				return err
+			}
+			entry := entries[n]
+			if !long {
+				entry = abbreviateHome(entry)
+			}
+			fmt.Fprintln(s.Stdout, entry)
+			return nil
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			return usageError("dirs", arg+": invalid argument")
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'c':
+				dirStack = nil
+				return nil
+			case 'l':
+				long = true
+			case 'p':
+				perLine = true
+			case 'v':
+				numbered = true
+			default:
+				return invalidOption("dirs", "-"+string(c))
+			}
+		}
+	}
+
+	return s.printDirs(long, perLine, numbered)
+}
+
+// printDirs prints the stack in one of the formats of dirs.
+func (s *Shell) printDirs(long, perLine, numbered bool) error {
+	entries := dirEntries()
+	for i, entry := range entries {
+		if !long {
+			entries[i] = abbreviateHome(entry)
+		}
+	}
+
+	switch {
+	case numbered:
+		for i, entry := range entries {
+			fmt.Fprintf(s.Stdout, "%2d  %s\n", i, entry)
+		}
+	case perLine:
+		for _, entry := range entries {
+			fmt.Fprintln(s.Stdout, entry)
+		}
+	default:
+		fmt.Fprintln(s.Stdout, strings.Join(entries, " "))
+	}
+	return nil
+}
+
+// dirsFile is where the directory stack is kept between sessions.
+func dirsFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".gosh_dirs"), nil
+}
+
+// dirsLoaded is set when the session started with a saved stack, so that
+// turning savedirs off in it removes that stack.
+var dirsLoaded bool
+
+// loadDirs restores the directory stack saved by the last session, if it
+// was saved, dropping directories that no longer exist. A saved stack
+// means savedirs was on, so it is turned on again.
+func loadDirs() {
+	name, err := dirsFile()
+	if err != nil {
+		return
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	options.saveDirs, dirsLoaded = true, true
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		dir := scanner.Text()
+		if info, err := os.Stat(dir); err == nil && info.IsDir() && filepath.IsAbs(dir) {
+			dirStack = append(dirStack, dir)
+		}
+	}
+}
+
+// saveDirs writes the directory stack, one absolute path per line, for the
+// next session if savedirs is on. If it was turned off in this session,
+// the stack the session started with is removed, so that it is not
+// restored; otherwise the file is left alone.
+func saveDirs() {
+	name, err := dirsFile()
+	if err != nil {
+		return
+	}
+	if !options.saveDirs {
+		if dirsLoaded {
+			os.Remove(name)
+		}
+		return
+	}
+
+	file, err := os.Create(name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	for _, dir := range dirStack {
+		if abs, err := filepath.Abs(dir); err == nil {
+			fmt.Fprintln(file, abs)
+		}
+	}
+}
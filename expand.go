@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// shellVars holds variables set by NAME=value assignments that have not
+// been exported. Exported variables live in the process environment.
+var shellVars = make(map[string]string)
+
+// expandDollar expands the parameter reference at the start of rest, the
+// text following a '$'. It returns the value and the number of runes the
+// reference used, or n == 0 if rest does not start with one, in which case
+// the '$' is literal.
+func (s *Shell) expandDollar(rest []rune) (string, int) {
+	if len(rest) == 0 {
+		return "", 0
+	}
+
+	switch c := rest[0]; {
+	case c == '(':
+		end := matchParen(rest)
+		if end < 0 {
+			return "", 0
+		}
+		return s.commandSubst(string(rest[1:end])), end + 1
+	case c == '?':
+		return strconv.Itoa(s.lastStatus), 1
+	case c == '$':
+		return strconv.Itoa(os.Getpid()), 1
+	case c == '{':
+		for end := 1; end < len(rest); end++ {
+			if rest[end] == '}' {
+				return s.expandBraced(string(rest[1:end])), end + 1
+			}
+		}
+		return "", 0
+	case c == '0':
+		if s.scriptName != "" {
+			return s.scriptName, 1
+		}
+		return os.Args[0], 1
+	case c >= '1' && c <= '9' || c == '#' || c == '@' || c == '*':
+		value, _ := s.positional(string(c))
+		return value, 1
+	case c == '_' && (len(rest) == 1 || !isNameChar(rest[1])):
+		return s.lastArg, 1
+	case isNameStart(c):
+		n := 1
+		for n < len(rest) && isNameChar(rest[n]) {
+			n++
+		}
+		return lookupVar(string(rest[:n])), n
+	}
+
+	return "", 0
+}
+
+// lookupVar returns the value of the named variable, or "" if it is unset.
+func lookupVar(name string) string {
+	value, _ := findVar(name)
+	return value
+}
+
+// findVar returns the value of the named variable and whether it is set.
+// Shell variables shadow the environment, and an array's value is its
+// first element.
+func findVar(name string) (string, bool) {
+	if value, ok := shellVars[name]; ok {
+		return value, true
+	}
+	if arr, ok := arrayVars[name]; ok {
+		if len(arr) == 0 {
+			return "", false
+		}
+		return arr[0], true
+	}
+	if m, ok := assocVars[name]; ok {
+		value, ok := m["0"]
+		return value, ok
+	}
+	return os.LookupEnv(name)
+}
+
+// varNames returns the names of the variables that are set and start with
+// prefix, in order: shell variables, arrays and exported ones alike.
+func varNames(prefix string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string) {
+		if strings.HasPrefix(name, prefix) && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for name := range shellVars {
+		add(name)
+	}
+	for name := range arrayVars {
+		add(name)
+	}
+	for name := range assocVars {
+		add(name)
+	}
+	for _, entry := range os.Environ() {
+		if name, _, ok := strings.Cut(entry, "="); ok && isValidName(name) {
+			add(name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// setVar assigns a variable. A variable that is already exported stays
+// exported, so its new value reaches child processes too; assigning to an
+// array sets its first element.
+func setVar(name, value string) {
+	if arr, ok := arrayVars[name]; ok {
+		if len(arr) == 0 {
+			arr = append(arr, "")
+		}
+		arr[0] = value
+		arrayVars[name] = arr
+		return
+	}
+	if m, ok := assocVars[name]; ok {
+		m["0"] = value
+		return
+	}
+	if _, exported := os.LookupEnv(name); exported {
+		os.Setenv(name, value)
+		return
+	}
+	shellVars[name] = value
+}
+
+// unsetVar removes a variable, whether it is a shell variable, an array or
+// exported.
+func unsetVar(name string) {
+	delete(shellVars, name)
+	delete(arrayVars, name)
+	delete(assocVars, name)
+	os.Unsetenv(name)
+}
+
+// expandText removes the quotes from text and expands the $ references in
+// it, without splitting it into words or globbing. It is used for text
+// that is not a command word, such as an array subscript.
+func (s *Shell) expandText(text string) string {
+	var b strings.Builder
+	runes := []rune(text)
+	inSingle, inDouble := false, false
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case inSingle:
+			if r == '\'' {
+				inSingle = false
+			} else {
+				b.WriteRune(r)
+			}
+		case r == '\'' && !inDouble:
+			inSingle = true
+		case r == '"':
+			inDouble = !inDouble
+		case r == '\\' && i+1 < len(runes):
+			i++
+			b.WriteRune(runes[i])
+		case r == '$':
+			value, n := s.expandDollar(runes[i+1:])
+			if n == 0 {
+				b.WriteRune(r)
+				continue
+			}
+			b.WriteString(value)
+			i += n
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// matchParen returns the index in rest of the ')' closing the '(' at
+// rest[0], skipping quoted text and nested parentheses, or -1 if there is
+// none.
+func matchParen(rest []rune) int {
+	depth := 0
+	inSingle, inDouble := false, false
+
+	for i := 0; i < len(rest); i++ {
+		switch r := rest[i]; {
+		case inSingle:
+			inSingle = r != '\''
+		case r == '\\':
+			i++
+		case r == '"':
+			inDouble = !inDouble
+		case inDouble:
+		case r == '\'':
+			inSingle = true
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// commandSubst runs cmdLine in a subshell and returns what it wrote to
+// standard output, less any trailing newlines. The command's exit status
+// is kept in substStatus, which becomes the status of a command made only
+// of assignments. $(<file) reads file without running anything.
+func (s *Shell) commandSubst(cmdLine string) string {
+	if trimmed := strings.TrimSpace(cmdLine); strings.HasPrefix(trimmed, "<") && !strings.HasPrefix(trimmed, "<<") {
+		if text, ok := s.readSubst(trimmed); ok {
+			return text
+		}
+	}
+
+	var out bytes.Buffer
+	table := s.fds()
+	table.stdout = &out
+	// Input that is not a file would be used up by copying it to the
+	// subshell, whether it reads any or not
+	if _, ok := table.stdin.(*os.File); !ok {
+		table.stdin = nil
+	}
+	cmd, state, err := s.newSubshell(table, nil, cmdLine)
+	if err == nil {
+		err = cmd.Start()
+		state.Close()
+	}
+	if err == nil {
+		err = cmd.Wait()
+	}
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		s.reportError(err)
+	}
+	s.substStatus = exitStatus(err)
+	debugf("command substitution %q: status %d output %q", cmdLine, s.substStatus, out.String())
+
+	return strings.TrimRight(out.String(), "\n")
+}
+
+// readSubst reads the file of a $(<file) substitution. ok is false if
+// cmdLine is more than the one redirection, to be run as a command.
+func (s *Shell) readSubst(cmdLine string) (text string, ok bool) {
+	cmd, err := s.parseCommand(cmdLine, nil)
+	if err != nil || len(cmd.args) > 0 || len(cmd.assigns) > 0 || len(cmd.arrays) > 0 ||
+		len(cmd.redirs) != 1 || cmd.redirs[0].op != "<" || cmd.redirs[0].fd != 0 {
+		return "", false
+	}
+
+	data, err := os.ReadFile(cmd.redirs[0].target)
+	if err != nil {
+		s.reportError(err)
+		s.substStatus = 1
+		return "", true
+	}
+	s.substStatus = 0
+	return strings.TrimRight(string(data), "\n"), true
+}
+
+func isNameStart(r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func isNameChar(r rune) bool {
+	return isNameStart(r) || (r >= '0' && r <= '9')
+}
+
+// isValidName reports whether name can be used as a variable name.
+func isValidName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if i == 0 && !isNameStart(r) || !isNameChar(r) {
+			return false
+		}
+	}
+	return true
+}
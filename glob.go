@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func isGlobMeta(r rune) bool {
+	return r == '*' || r == '?' || r == '['
+}
+
+// hasGlobMeta reports whether pattern contains an unescaped glob
+// metacharacter.
+func hasGlobMeta(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeGlob removes the backslashes protecting characters in pattern.
+func unescapeGlob(pattern string) string {
+	if !strings.Contains(pattern, "\\") {
+		return pattern
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+		}
+		b.WriteByte(pattern[i])
+	}
+	return b.String()
+}
+
+// expandGlob returns the sorted paths matching pattern, or nil if there
+// are none. Matching is done one path component at a time so options such
+// as nocaseglob apply to every directory level.
+func expandGlob(pattern string) []string {
+	base := ""
+	if strings.HasPrefix(pattern, "/") {
+		base = "/"
+	}
+	dirsOnly := strings.HasSuffix(pattern, "/")
+
+	paths := []string{base}
+	parts := strings.Split(pattern, "/")
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+
+		var next []string
+		if part == "**" && options.globstar {
+			last := i == len(parts)-1
+			for _, dir := range paths {
+				next = append(next, globstarPaths(dir, last)...)
+			}
+			paths = next
+			continue
+		}
+
+		for _, dir := range paths {
+			if !hasGlobMeta(part) {
+				next = append(next, joinGlobPath(dir, unescapeGlob(part)))
+				continue
+			}
+
+			readDir := dir
+			if readDir == "" {
+				readDir = "."
+			}
+			entries, err := os.ReadDir(readDir)
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				if globMatch(part, entry.Name()) {
+					next = append(next, joinGlobPath(dir, entry.Name()))
+				}
+			}
+		}
+		paths = next
+	}
+
+	var matches []string
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		info, err := os.Stat(path)
+		if err != nil {
+			if _, lerr := os.Lstat(path); lerr != nil {
+				continue
+			}
+		}
+		if dirsOnly {
+			if err != nil || !info.IsDir() {
+				continue
+			}
+			path += "/"
+		}
+		matches = append(matches, path)
+	}
+	sort.Strings(matches)
+
+	return matches
+}
+
+// globstarPaths expands a ** component under dir: every directory below
+// it, plus dir itself since ** also matches zero directories. When ** is
+// the last component, files are included too. Symbolic links to
+// directories are not followed, which keeps cycles from looping forever.
+func globstarPaths(dir string, last bool) []string {
+	root := dir
+	if root == "" {
+		root = "."
+	}
+
+	var found []string
+	if !last {
+		found = append(found, dir)
+	}
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") && !options.dotglob {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || last {
+			rel, err := filepath.Rel(root, path)
+			if err == nil {
+				found = append(found, joinGlobPath(dir, rel))
+			}
+		}
+		return nil
+	})
+
+	return found
+}
+
+// joinGlobPath appends name to dir without cleaning the result, so a
+// pattern like ./*.go expands to ./main.go rather than main.go.
+func joinGlobPath(dir, name string) string {
+	switch dir {
+	case "":
+		return name
+	case "/":
+		return "/" + name
+	}
+	return dir + "/" + name
+}
+
+// globMatch matches a single path component against one pattern
+// component, folding case when nocaseglob is set. As in bash, a leading
+// dot in name must be matched by a literal dot unless dotglob is set.
+func globMatch(pattern, name string) bool {
+	if strings.HasPrefix(name, ".") && !options.dotglob &&
+		!strings.HasPrefix(pattern, ".") && !strings.HasPrefix(pattern, "\\.") {
+		return false
+	}
+	if options.nocaseglob {
+		pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+	}
+	ok, err := filepath.Match(pattern, name)
+	return err == nil && ok
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// builtinHelp describes each builtin for help and for the usage line that
+// follows an argument error: usage is its synopsis, without the name, and
+// summary says what it does.
+var builtinHelp = map[string]struct{ usage, summary string }{
+	"cd":        {"[-L|-P] [dir]", "Change the current directory to dir, $CDHOME or $HOME by default, or $OLDPWD for -; with shopt cdfile, a file means the directory it is in."},
+	"pushd":     {"[dir | +N | -N]", "Save the current directory on the stack and change to dir, or swap or rotate the stack."},
+	"popd":      {"[+N | -N]", "Remove the top directory, or entry N, from the stack and change to the new top."},
+	"dirs":      {"[-clpv] [+N | -N]", "Print the directory stack; -c clears it, -l gives full paths, -p one per line, -v numbered."},
+	"exit":      {"[-f] [n]", "Exit the shell with status n, or the status of the last command; -f even with jobs running."},
+	"pwd":       {"[-LP]", "Print the current directory, logically (-L) or with symlinks resolved (-P)."},
+	"export":    {"[-n] name[=value] ...", "Set each name in the environment of later commands, or with -n take it out, keeping it as a shell variable."},
+	"echo":      {"[-neE] [arg ...]", "Print the arguments, separated by spaces; -n omits the newline, -e and -E turn escapes on and off."},
+	"exec":      {"[command [arg ...]] [redirection ...]", "Replace the shell with command, or with no command, apply the redirections to the shell itself."},
+	"printf":    {"[-v var] format [arguments]", "Print the arguments under the control of format, as printf(1) does, or with -v assign the result to var."},
+	"history":   {"[--json] [n]", "List the command history, or its last n entries, as JSON with --json."},
+	"alias":     {"[name=value ...]", "Define aliases, or list them all."},
+	"unalias":   {"name ...", "Remove each named alias."},
+	"jobs":      {"[-lprs] [--json]", "List the jobs, with their process IDs for -l, or only their process groups for -p; -r and -s list only running or stopped jobs, and --json lists them as JSON."},
+	"fg":        {"[job_spec]", "Bring a job to the foreground, continuing it if it is stopped."},
+	"bg":        {"[job_spec]", "Continue a stopped job in the background."},
+	"coproc":    {"[NAME] command [arg ...]", "Run command in the background with pipes: read its output on ${NAME[0]} and write its input on ${NAME[1]}; NAME defaults to COPROC."},
+	"kill":      {"[-s sig | -sig] pid | %job ... or kill -l [sig ...]", "Send a signal, SIGTERM by default, to processes or jobs, or list the signals."},
+	"wait":      {"[-n] [pid | %job ...]", "Wait for jobs to finish, or with -n for the next one, and return its status."},
+	"suspend":   {"[-f]", "Stop the shell until it is continued; -f allows a login shell to stop."},
+	"source":    {"filename [arg ...]", "Run the commands in filename in the current shell."},
+	".":         {"filename [arg ...]", "Run the commands in filename in the current shell."},
+	"tee":       {"[-a] [file ...]", "Copy standard input to standard output and each file, appending with -a."},
+	"confirm":   {"command [args ...]", "Ask on the terminal before running command."},
+	"umask":     {"[mode]", "Print the file creation mask, or set it to the octal mode."},
+	"ulimit":    {"[-SHa] [-cdfnstuv] [limit]", "Print or set a resource limit of the shell and its children."},
+	"set":       {"[-e|+e] [-o|+o option ...] [--] [arg ...]", "Enable (-o) or disable (+o) shell options, or list them, and set the positional parameters."},
+	"shopt":     {"[-squ] [optname ...]", "Set (-s), unset (-u) or query shell options."},
+	"version":   {"", "Print the version of the shell."},
+	"mapfile":   {"[-t] [-n count] [array]", "Read lines from standard input into an indexed array, MAPFILE by default."},
+	"readarray": {"[-t] [-n count] [array]", "Read lines from standard input into an indexed array, MAPFILE by default."},
+	"declare":   {"[-aAp] [name[=value] ...]", "Declare indexed (-a) or associative (-A) arrays, or print variables (-p)."},
+	"times":     {"", "Print the user and system CPU time used by the shell and its children."},
+	"type":      {"[-a] name ...", "Say how each name would run as a command; -a lists every alias, builtin and program on PATH it could be."},
+	"id":        {"[-ugGn] [user]", "Print the user and group IDs of the current user, or of user; -u, -g and -G print one kind only, -n as names."},
+	"timeout":   {"[-s sig] [-k duration] duration command [arg ...]", "Run command, signalling it with SIGTERM or sig if it runs longer than duration, then SIGKILL 10s or the -k duration later (never for -k 0), and exit 124 if it did."},
+	"repeat":    {"count command [arg ...]", "Run command count times."},
+	"watch":     {"[-n seconds] command [arg ...]", "Run command every two seconds, or every -n seconds, clearing the screen each time, until interrupted."},
+	"help":      {"[pattern ...]", "Describe the builtins whose names match pattern, or list them all."},
+	"shift":     {"[n]", "Drop the first n positional parameters, one by default."},
+
+	"history-search": {"[-n count] query", "List the commands in the history that contain the letters of query in order, best first, and offer to run one."},
+}
+
+// usageError reports a builtin invoked with bad arguments, followed by its
+// usage line. An empty msg gives the usage line alone.
+func usageError(name, msg string) error {
+	usage := fmt.Sprintf("%s: usage: %s", name, synopsis(name))
+	if msg == "" {
+		return usageErrorf("%s", usage)
+	}
+	return usageErrorf("%s: %s\n%s", name, msg, usage)
+}
+
+// synopsis returns the usage line of a builtin, starting with its name.
+func synopsis(name string) string {
+	if usage := builtinHelp[name].usage; usage != "" {
+		return name + " " + usage
+	}
+	return name
+}
+
+// invalidOption reports an option a builtin does not accept.
+func invalidOption(name, opt string) error {
+	return usageError(name, opt+": invalid option")
+}
+
+// handleHelp lists the usage of every builtin, or describes those whose
+// names match one of the glob patterns given.
+func (s *Shell) handleHelp(args []string) error {
+	names := make([]string, 0, len(builtinHelp))
+	for name := range builtinHelp {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(args) == 1 {
+		for _, name := range names {
+			fmt.Fprintln(s.Stdout, synopsis(name))
+		}
+		return nil
+	}
+
+	for _, pattern := range args[1:] {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return usageError("help", pattern+": invalid pattern")
+		}
+	}
+
+	found := false
+	for _, name := range names {
+		for _, pattern := range args[1:] {
+			if ok, _ := path.Match(pattern, name); ok {
+				fmt.Fprintf(s.Stdout, "%s: %s\n    %s\n", name, synopsis(name), builtinHelp[name].summary)
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("help: no help topics match `%s'", args[len(args)-1])
+	}
+
+	return nil
+}
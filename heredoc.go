@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// hereDoc is the body of a <<DELIM redirection, read from the lines that
+// follow the command line.
+type hereDoc struct {
+	delim string
+	body  string
+	// stripTabs is set for <<-, which removes leading tabs from the body
+	// and the delimiter line.
+	stripTabs bool
+	// quoted is set if any part of the delimiter was quoted, which leaves
+	// the body unexpanded.
+	quoted bool
+}
+
+// scanHereDocs returns the here-documents cmdStr redirects from, in order,
+// with their bodies not yet read.
+func scanHereDocs(cmdStr string) []*hereDoc {
+	var docs []*hereDoc
+	runes := []rune(cmdStr)
+	inSingle, inDouble := false, false
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case inSingle:
+			inSingle = r != '\''
+		case r == '\\':
+			i++
+		case r == '"':
+			inDouble = !inDouble
+		case r == '$' && i+1 < len(runes) && runes[i+1] == '(':
+			// Command substitutions are run as lines of their own
+			if n := matchParen(runes[i+1:]); n >= 0 {
+				i += 1 + n
+			}
+		case r == '`':
+			for i++; i < len(runes) && runes[i] != '`'; i++ {
+				if runes[i] == '\\' {
+					i++
+				}
+			}
+		case inDouble:
+		case r == '\'':
+			inSingle = true
+		case r == '<' && i+1 < len(runes) && runes[i+1] == '<':
+			doc := &hereDoc{}
+			i += 2
+			if i < len(runes) && runes[i] == '-' {
+				doc.stripTabs = true
+				i++
+			}
+			for i < len(runes) && (runes[i] == ' ' || runes[i] == '\t') {
+				i++
+			}
+			i += readDelimiter(runes[i:], doc) - 1
+			docs = append(docs, doc)
+		}
+	}
+
+	return docs
+}
+
+// readDelimiter reads the delimiter word at the start of rest into doc,
+// removing any quotes, and returns the number of runes it used.
+func readDelimiter(rest []rune, doc *hereDoc) int {
+	var delim strings.Builder
+	var quote rune
+	i := 0
+
+	for ; i < len(rest); i++ {
+		r := rest[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				delim.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			doc.quoted = true
+		case r == '\\' && i+1 < len(rest):
+			i++
+			delim.WriteRune(rest[i])
+			doc.quoted = true
+		case strings.ContainsRune(" \t;|&<>()", r):
+			doc.delim = delim.String()
+			return i
+		default:
+			delim.WriteRune(r)
+		}
+	}
+
+	doc.delim = delim.String()
+	return i
+}
+
+// readHereDocs reads the bodies of the here-documents of every command in
+// a parsed command line from the input that follows it, in the order they
+// appear.
+func (s *Shell) readHereDocs(n node) error {
+	switch n := n.(type) {
+	case *pipelineNode:
+		n.hereDocs = make([][]*hereDoc, len(n.commands))
+		for i, cmdStr := range n.commands {
+			n.hereDocs[i] = scanHereDocs(cmdStr)
+			for _, doc := range n.hereDocs[i] {
+				if err := s.readHereDoc(doc); err != nil {
+					return err
+				}
+			}
+		}
+	case *listNode:
+		if err := s.readHereDocs(n.left); err != nil {
+			return err
+		}
+		return s.readHereDocs(n.right)
+	}
+	return nil
+}
+
+// readHereDoc reads lines into doc's body up to its delimiter line. Like
+// bash, it warns and keeps what it has if the input ends first. Bodies
+// already read for a command line that is being run again, as the value
+// of an alias, are taken from pendingHereDocs instead.
+func (s *Shell) readHereDoc(doc *hereDoc) error {
+	if doc.delim == "" {
+		return errors.New("syntax error near unexpected token `newline'")
+	}
+
+	if len(s.pendingHereDocs) > 0 {
+		doc.body = s.pendingHereDocs[0].body
+		s.pendingHereDocs = s.pendingHereDocs[1:]
+		return nil
+	}
+
+	var body strings.Builder
+	for {
+		line, ok := "", false
+		if s.nextLine != nil {
+			line, ok = s.nextLine()
+		}
+		if !ok {
+			fmt.Fprintf(s.Stderr, "warning: here-document delimited by end-of-file (wanted `%s')\n", doc.delim)
+			break
+		}
+
+		if doc.stripTabs {
+			line = strings.TrimLeft(line, "\t")
+		}
+		if line == doc.delim {
+			break
+		}
+		body.WriteString(line)
+		body.WriteByte('\n')
+	}
+
+	doc.body = body.String()
+	return nil
+}
+
+// expandHereDoc expands the $ references and command substitutions in a
+// here-document body. Quotes are ordinary characters there, and a
+// backslash only escapes $, `, \ and newline.
+func (s *Shell) expandHereDoc(body string) string {
+	var b strings.Builder
+	runes := []rune(body)
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && i+1 < len(runes) && strings.ContainsRune("$`\\\n", runes[i+1]):
+			i++
+			if runes[i] != '\n' {
+				b.WriteRune(runes[i])
+			}
+		case r == '$':
+			value, n := s.expandDollar(runes[i+1:])
+			if n == 0 {
+				b.WriteRune(r)
+				continue
+			}
+			b.WriteString(value)
+			i += n
+		case r == '`':
+			end := i + 1
+			for end < len(runes) && runes[end] != '`' {
+				end++
+			}
+			if end == len(runes) {
+				b.WriteRune(r)
+				continue
+			}
+			b.WriteString(s.commandSubst(string(runes[i+1 : end])))
+			i = end
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// expandHistory replaces history references in an interactive input line
+// with the commands they name, reporting whether anything was replaced.
+// Supported events are !! (the previous command), !n, !-n, !prefix,
+// !?substring? and !$ (the last word of the previous command). References
+// inside single quotes, or followed by a blank, = or (, are left alone.
+// A reference followed by the :p modifier sets printOnly: the line is to
+// be shown and remembered, but not run.
+func expandHistory(line string) (expanded string, changed, printOnly bool, err error) {
+	var out strings.Builder
+	runes := []rune(line)
+	inSingle, inDouble := false, false
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case r == '\'' && !inDouble:
+			inSingle = !inSingle
+		case r == '"' && !inSingle:
+			inDouble = !inDouble
+		case r == '\\' && i+1 < len(runes) && runes[i+1] == '!':
+			out.WriteRune(r)
+			out.WriteRune('!')
+			i++
+			continue
+		case r == '!' && !inSingle:
+			text, n, err := historyEvent(runes[i+1:])
+			if err != nil {
+				return "", false, false, err
+			}
+			if n > 0 {
+				out.WriteString(text)
+				i += n
+				changed = true
+				if rest := runes[i+1:]; len(rest) >= 2 && rest[0] == ':' && rest[1] == 'p' &&
+					(len(rest) == 2 || !isNameChar(rest[2])) {
+					printOnly = true
+					i += 2
+				}
+				continue
+			}
+		}
+
+		out.WriteRune(r)
+	}
+
+	return out.String(), changed, printOnly, nil
+}
+
+// historyEvent resolves the event designator at the start of rest (the
+// text after a '!'), returning its expansion and how many runes it used.
+// It returns n == 0 if rest does not start with an event designator.
+func historyEvent(rest []rune) (string, int, error) {
+	if len(rest) == 0 || strings.ContainsRune(" \t\n=(", rest[0]) {
+		return "", 0, nil
+	}
+
+	switch c := rest[0]; {
+	case c == '!':
+		cmd, err := historyEntry(-1, "!!")
+		return cmd, 1, err
+	case c == '$':
+		cmd, err := historyEntry(-1, "!$")
+		if err != nil {
+			return "", 0, err
+		}
+		words := strings.Fields(cmd)
+		if len(words) == 0 {
+			return "", 1, nil
+		}
+		return words[len(words)-1], 1, nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		n := 1
+		for n < len(rest) && rest[n] >= '0' && rest[n] <= '9' {
+			n++
+		}
+		num, err := strconv.Atoi(string(rest[:n]))
+		if err != nil {
+			return "", 0, fmt.Errorf("!%s: event not found", string(rest[:n]))
+		}
+		if num > 0 {
+			num--
+		}
+		cmd, err := historyEntry(num, "!"+string(rest[:n]))
+		return cmd, n, err
+	case c == '?':
+		end := 1
+		for end < len(rest) && rest[end] != '?' {
+			end++
+		}
+		needle := string(rest[1:end])
+		n := end
+		if end < len(rest) {
+			n++
+		}
+		for i := len(history) - 1; i >= 0; i-- {
+			if strings.Contains(history[i], needle) {
+				return history[i], n, nil
+			}
+		}
+		return "", 0, fmt.Errorf("!?%s: event not found", needle)
+	}
+
+	n := 0
+	for n < len(rest) && !strings.ContainsRune(" \t\n;&|<>\"':", rest[n]) {
+		n++
+	}
+	if n == 0 {
+		return "", 0, nil
+	}
+	prefix := string(rest[:n])
+	for i := len(history) - 1; i >= 0; i-- {
+		if strings.HasPrefix(history[i], prefix) {
+			return history[i], n, nil
+		}
+	}
+	return "", 0, fmt.Errorf("!%s: event not found", prefix)
+}
+
+// historyEntry returns history entry i, counting back from the most recent
+// entry when i is negative.
+func historyEntry(i int, ref string) (string, error) {
+	if i < 0 {
+		i += len(history)
+	}
+	if i < 0 || i >= len(history) {
+		return "", fmt.Errorf("%s: event not found", ref)
+	}
+	return history[i], nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// defaultSearchResults is how many matches history-search shows without -n.
+const defaultSearchResults = 10
+
+// historyMatch is a history entry that matched a fuzzy search.
+type historyMatch struct {
+	index int
+	score int
+}
+
+// fuzzyScore reports whether the letters of query appear in text in
+// order, ignoring case, and scores how well: letters that follow one
+// another or start a word count for more, and gaps between them against.
+func fuzzyScore(query, text string) (int, bool) {
+	q := []rune(strings.ToLower(query))
+	t := []rune(strings.ToLower(text))
+	if len(q) == 0 {
+		return 0, true
+	}
+
+	score, qi, last := 0, 0, -1
+	for ti := 0; ti < len(t) && qi < len(q); ti++ {
+		if t[ti] != q[qi] {
+			continue
+		}
+		switch {
+		case last >= 0 && ti == last+1:
+			score += 8
+		case ti == 0 || !unicode.IsLetter(t[ti-1]) && !unicode.IsDigit(t[ti-1]):
+			score += 6
+		default:
+			score += 2
+		}
+		if last >= 0 {
+			score -= min(ti-last-1, 5)
+		}
+		last = ti
+		qi++
+	}
+	return score, qi == len(q)
+}
+
+// searchHistory returns the history entries that fuzzily match query, best
+// first, and most recent first among equals. Each command appears once.
+func searchHistory(query string) []historyMatch {
+	seen := make(map[string]bool)
+	var matches []historyMatch
+	for i := len(history) - 1; i >= 0; i-- {
+		if seen[history[i]] {
+			continue
+		}
+		seen[history[i]] = true
+		if score, ok := fuzzyScore(query, history[i]); ok {
+			matches = append(matches, historyMatch{index: i, score: score})
+		}
+	}
+	sort.SliceStable(matches, func(a, b int) bool {
+		return matches[a].score > matches[b].score
+	})
+	return matches
+}
+
+// handleHistorySearch lists the commands in the history that match a
+// fuzzy query, the best ten or -n count of them, numbered as history
+// numbers them. In an interactive shell it then asks for one to run.
+func (s *Shell) handleHistorySearch(args []string) error {
+	count := defaultSearchResults
+	words := args[1:]
+	if len(words) > 0 && words[0] == "-n" {
+		if len(words) < 2 {
+			return usageError("history-search", "-n: option requires an argument")
+		}
+		n, err := strconv.Atoi(words[1])
+		if err != nil || n < 1 {
+			return usageError("history-search", words[1]+": invalid count")
+		}
+		count = n
+		words = words[2:]
+	}
+	if len(words) == 0 {
+		return usageError("history-search", "")
+	}
+
+	// The search itself is the last entry; it should not find itself
+	query := strings.Join(words, " ")
+	matches := searchHistory(query)
+	filtered := matches[:0]
+	for _, m := range matches {
+		if m.index != len(history)-1 || !s.interactive {
+			filtered = append(filtered, m)
+		}
+	}
+	matches = filtered[:min(count, len(filtered))]
+	if len(matches) == 0 {
+		fmt.Fprintf(s.Stderr, "history-search: %s: no matches\n", query)
+		return silentStatus(1)
+	}
+	for _, m := range matches {
+		fmt.Fprintf(s.Stdout, "%4d  %s\n", m.index+1, history[m.index])
+	}
+	if !s.interactive || s.subshell {
+		return nil
+	}
+
+	answer, err := readTerminalLine("Run which? ")
+	if err != nil || answer == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(answer)
+	if err != nil || n < 1 || n > len(history) {
+		return fmt.Errorf("history-search: %s: no such entry", answer)
+	}
+	line := history[n-1]
+	fmt.Fprintln(s.Stdout, line)
+	history = append(history, line)
+	return s.execNested(line)
+}
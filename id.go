@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strings"
+)
+
+// handleID prints the user and group IDs of the current user, or of the
+// user named, as id(1) does. -u, -g and -G print only the user ID, the
+// group ID or all the group IDs, and -n prints names instead of numbers
+// for those.
+func (s *Shell) handleID(args []string) error {
+	var only rune
+	names := false
+	words := args[1:]
+	for len(words) > 0 && strings.HasPrefix(words[0], "-") && words[0] != "-" {
+		opt := words[0]
+		words = words[1:]
+		if opt == "--" {
+			break
+		}
+		for _, c := range opt[1:] {
+			switch c {
+			case 'u', 'g', 'G':
+				if only != 0 && only != c {
+					return usageError("id", "cannot print \"only\" of more than one choice")
+				}
+				only = c
+			case 'n':
+				names = true
+			default:
+				return invalidOption("id", "-"+string(c))
+			}
+		}
+	}
+	if names && only == 0 {
+		return usageError("id", "cannot print only names in default format")
+	}
+	if len(words) > 1 {
+		return usageError("id", "extra operand "+shellQuote(words[1]))
+	}
+
+	var u *user.User
+	var err error
+	if len(words) == 1 {
+		u, err = user.Lookup(words[0])
+	} else {
+		u, err = user.Current()
+	}
+	if err != nil {
+		var unknown user.UnknownUserError
+		if errors.As(err, &unknown) {
+			return fmt.Errorf("id: %s: no such user", words[0])
+		}
+		return fmt.Errorf("id: %w", err)
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		gids = []string{u.Gid}
+	}
+
+	// show gives an ID as a number or a name, as the options ask
+	show := func(id, name string) string {
+		if names {
+			return name
+		}
+		return id
+	}
+
+	switch only {
+	case 'u':
+		fmt.Fprintln(s.Stdout, show(u.Uid, u.Username))
+	case 'g':
+		fmt.Fprintln(s.Stdout, show(u.Gid, groupName(u.Gid)))
+	case 'G':
+		groups := make([]string, len(gids))
+		for i, gid := range gids {
+			groups[i] = show(gid, groupName(gid))
+		}
+		fmt.Fprintln(s.Stdout, strings.Join(groups, " "))
+	default:
+		groups := make([]string, len(gids))
+		for i, gid := range gids {
+			groups[i] = fmt.Sprintf("%s(%s)", gid, groupName(gid))
+		}
+		fmt.Fprintf(s.Stdout, "uid=%s(%s) gid=%s(%s) groups=%s\n",
+			u.Uid, u.Username, u.Gid, groupName(u.Gid), strings.Join(groups, ","))
+	}
+	return nil
+}
+
+// groupName returns the name of the group gid, or gid itself if it has
+// none.
+func groupName(gid string) string {
+	if g, err := user.LookupGroupId(gid); err == nil {
+		return g.Name
+	}
+	return gid
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+)
+
+// stripComment removes the comment from a command line: an unquoted # at
+// the start of a word, and the rest of the line after it.
+func stripComment(line string) string {
+	runes := []rune(line)
+	inSingle, inDouble := false, false
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case inSingle:
+			inSingle = r != '\''
+		case r == '\\':
+			i++
+		case r == '"':
+			inDouble = !inDouble
+		case r == '$' && i+1 < len(runes) && runes[i+1] == '(':
+			if n := matchParen(runes[i+1:]); n >= 0 {
+				i += 1 + n
+			}
+		case r == '`':
+			for i++; i < len(runes) && runes[i] != '`'; i++ {
+				if runes[i] == '\\' {
+					i++
+				}
+			}
+		case inDouble:
+		case r == '\'':
+			inSingle = true
+		case r == '#' && (i == 0 || strings.ContainsRune(" \t;&|()", runes[i-1])):
+			return string(runes[:i])
+		}
+	}
+
+	return line
+}
+
+// continues reports whether a command line ends with a backslash that is
+// not quoted or escaped, which joins the next line to it. A backslash in
+// a comment does not count.
+func continues(line string) bool {
+	line = stripComment(line)
+	if !strings.HasSuffix(line, `\`) {
+		return false
+	}
+
+	inSingle := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case inSingle:
+			inSingle = line[i] != '\''
+		case line[i] == '\'':
+			inSingle = true
+		case line[i] == '\\':
+			if i == len(line)-1 {
+				return true
+			}
+			i++
+		}
+	}
+	return false
+}
+
+// openQuote returns the quote character, ' " or `, that a command line
+// leaves open at its end, or 0 if every quote is closed. Quotes in a
+// comment do not count.
+func openQuote(line string) rune {
+	runes := []rune(stripComment(line))
+	var open rune
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case open == '\'':
+			if r == '\'' {
+				open = 0
+			}
+		case r == '\\':
+			i++
+		case open == '"' && r == '"', open == '`' && r == '`':
+			open = 0
+		case open == 0 && (r == '\'' || r == '"' || r == '`'):
+			open = r
+		}
+	}
+	return open
+}
+
+// joinContinuations joins the lines that follow line to it, read with
+// nextLine, for as long as each ends in a backslash that continues it.
+// The backslash and newline are removed, as they are in interactive input,
+// scripts and sourced files alike. An interactive shell also reads on
+// while a quote is left open, keeping the newline as part of the quoted
+// text; elsewhere that is a syntax error for parseCommand to report.
+func (s *Shell) joinContinuations(line string) string {
+	for s.nextLine != nil {
+		// A backslash continues a line even inside double quotes; only
+		// a line with a quote open and no backslash keeps its newline
+		joined := continues(line)
+		quoted := !joined && s.interactive && openQuote(line) != 0
+		if !joined && !quoted {
+			break
+		}
+		next, ok := s.nextLine()
+		if joined {
+			line = strings.TrimSuffix(line, `\`)
+		}
+		if !ok {
+			break
+		}
+		if quoted {
+			line += "\n"
+		}
+		line += next
+	}
+	return line
+}
@@ -0,0 +1,710 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type Job struct {
+	ID int
+	// PID is the job's last process, whose status is the job's, and PIDs
+	// all of them in pipeline order. They share the process group Pgid.
+	PID     int
+	PIDs    []int
+	Pgid    int
+	Command string
+	Stopped bool
+
+	// done is closed once the job has finished, after err is set to the
+	// result of waiting for it. stopped receives a value each time the
+	// job stops.
+	done    chan struct{}
+	err     error
+	stopped chan struct{}
+
+	// cmds are the job's processes. pending counts those the SIGCHLD
+	// handler has not yet reaped, and procErr is the result of the last.
+	// reaped is closed once they have all been, and unless finishOnReap
+	// is set, the job is then finished by whoever started it.
+	cmds         []*exec.Cmd
+	pending      int
+	procErr      error
+	reaped       chan struct{}
+	finishOnReap bool
+
+	// user and sys add up the CPU time of the processes that have exited.
+	user, sys time.Duration
+
+	// inherited is set in a subshell for the jobs of the shell that
+	// started it, which are not its children to wait for.
+	inherited bool
+}
+
+// newJob returns a job for processes that have been started. It has no ID
+// until it is added to the jobs table.
+func newJob(cmds []*exec.Cmd, pgid int, command string) *Job {
+	job := &Job{
+		Pgid:    pgid,
+		Command: command,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}, 1),
+		cmds:    cmds,
+		reaped:  make(chan struct{}),
+	}
+	for _, cmd := range cmds {
+		job.PIDs = append(job.PIDs, cmd.Process.Pid)
+	}
+	if len(cmds) > 0 {
+		job.PID = job.PIDs[len(job.PIDs)-1]
+	}
+	return job
+}
+
+// currentJob and previousJob are the IDs of the jobs that %+ and %- refer
+// to, marked + and - by jobs, or 0 if there is none. They are guarded by
+// jobsMutex.
+var currentJob, previousJob int
+
+// finishedJobs holds the jobs that finished and were removed from the
+// table before anything waited for them, by ID, so that a later wait can
+// still take on their status. Like bash, which keeps as many as CHILD_MAX,
+// it holds only the most recent maxFinishedJobs. It is guarded by
+// jobsMutex.
+var finishedJobs = make(map[int]*Job)
+
+const maxFinishedJobs = 256
+
+// addJob gives a job an ID and adds it to the jobs table as the current
+// job. The caller holds jobsMutex.
+func addJob(job *Job) {
+	job.ID = jobCounter
+	jobs[jobCounter] = job
+	jobCounter++
+	makeCurrent(job)
+}
+
+// makeCurrent makes job the current job, and the one that was current the
+// previous job. The caller holds jobsMutex.
+func makeCurrent(job *Job) {
+	if currentJob != job.ID {
+		previousJob = currentJob
+		currentJob = job.ID
+	}
+}
+
+// removeJob deletes a job from the table. If it was the current job the
+// previous one takes its place, and the most recent other job becomes the
+// previous one. The caller holds jobsMutex.
+func removeJob(id int) {
+	if job := jobs[id]; job.finished() {
+		finishedJobs[id] = job
+		if len(finishedJobs) > maxFinishedJobs {
+			delete(finishedJobs, slices.Min(slices.Collect(maps.Keys(finishedJobs))))
+		}
+	}
+	delete(jobs, id)
+	if id == currentJob {
+		currentJob, previousJob = previousJob, 0
+	}
+	if id == previousJob {
+		previousJob = 0
+	}
+	if currentJob == 0 {
+		currentJob = latestJob(0)
+	}
+	if previousJob == 0 {
+		previousJob = latestJob(currentJob)
+	}
+}
+
+// latestJob returns the ID of the most recent job other than except, or 0
+// if there is none. The caller holds jobsMutex.
+func latestJob(except int) int {
+	ids := sortedJobIDs()
+	for i := len(ids) - 1; i >= 0; i-- {
+		if ids[i] != except {
+			return ids[i]
+		}
+	}
+	return 0
+}
+
+// jobMarker returns the mark jobs shows after a job's ID: + for the
+// current job, - for the previous one. The caller holds jobsMutex.
+func jobMarker(id int) byte {
+	switch id {
+	case currentJob:
+		return '+'
+	case previousJob:
+		return '-'
+	}
+	return ' '
+}
+
+// startBackground adds a job started in the background and announces it.
+func (s *Shell) startBackground(job *Job) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	addJob(job)
+	fmt.Fprintf(s.Stdout, "[%d] %d\n", job.ID, job.PID)
+}
+
+// waitForeground waits for a job that has the terminal. If it stops
+// instead of finishing, it is added to the jobs table and reported, and
+// the shell carries on with status 128+SIGTSTP. Stops are only noticed
+// under job control; otherwise the shell waits until the job is continued
+// from elsewhere.
+func (s *Shell) waitForeground(job *Job) error {
+	stopped := job.stopped
+	if ttyFd < 0 {
+		stopped = nil
+	}
+
+	select {
+	case <-job.done:
+		jobsMutex.Lock()
+		if jobs[job.ID] == job {
+			removeJob(job.ID)
+		}
+		waitedUser += job.user
+		waitedSys += job.sys
+		jobsMutex.Unlock()
+		return job.err
+	case <-stopped:
+		jobsMutex.Lock()
+		if jobs[job.ID] != job {
+			addJob(job)
+		}
+		makeCurrent(job)
+		fmt.Fprintf(s.Stdout, "\n[%d]%c  Stopped\t%s\n", job.ID, jobMarker(job.ID), job.Command)
+		jobsMutex.Unlock()
+		return silentStatus(128 + int(syscall.SIGTSTP))
+	}
+}
+
+// finish records the result of waiting for the job.
+func (j *Job) finish(err error) {
+	j.err = err
+	close(j.done)
+}
+
+// finished reports whether the job has finished, without waiting.
+func (j *Job) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// signal sends sig to every process of the job through its process group.
+func (j *Job) signal(sig syscall.Signal) error {
+	if j.Pgid == 0 {
+		return fmt.Errorf("%%%d: job has no processes", j.ID)
+	}
+	return syscall.Kill(-j.Pgid, sig)
+}
+
+// state describes the job as jobs lists it.
+func (j *Job) state() string {
+	switch {
+	case j.finished() && j.err == nil:
+		return "Done"
+	case j.finished():
+		var waitErr *waitError
+		if errors.As(j.err, &waitErr) && waitErr.status.Signaled() {
+			name := waitErr.status.Signal().String()
+			return strings.ToUpper(name[:1]) + name[1:]
+		}
+		return fmt.Sprintf("Exit %d", exitStatus(j.err))
+	case j.Stopped:
+		return "Stopped"
+	}
+	return "Running"
+}
+
+// line describes the job as jobs lists it: its ID and mark, its state and
+// its command. The caller holds jobsMutex.
+func (j *Job) line() string {
+	return fmt.Sprintf("[%d]%c  %s\t%s", j.ID, jobMarker(j.ID), j.state(), j.Command)
+}
+
+// warnJobs reports the jobs still running or stopped, returning false if
+// there are none.
+func (s *Shell) warnJobs() bool {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	var left []*Job
+	stopped := false
+	for _, id := range sortedJobIDs() {
+		if job := jobs[id]; !job.finished() {
+			left = append(left, job)
+			stopped = stopped || job.Stopped
+		}
+	}
+	if len(left) == 0 {
+		return false
+	}
+
+	if stopped {
+		fmt.Fprintln(s.Stderr, "There are stopped jobs.")
+	} else {
+		fmt.Fprintln(s.Stderr, "There are running jobs.")
+	}
+	for _, job := range left {
+		fmt.Fprintln(s.Stderr, job.line())
+	}
+	return true
+}
+
+// resolveJobSpec returns the job named by a job spec: %n or n for job n,
+// %string for the job whose command starts with string, %?string for the
+// one whose command contains it, %- for the previous job, and %%, %+, %
+// or "" for the current job. The caller holds jobsMutex.
+func resolveJobSpec(spec string) (*Job, error) {
+	switch spec {
+	case "", "%", "%%", "%+":
+		if currentJob == 0 {
+			return nil, errors.New("no current job")
+		}
+		return jobs[currentJob], nil
+	case "%-":
+		if previousJob == 0 {
+			return resolveJobSpec("")
+		}
+		return jobs[previousJob], nil
+	}
+
+	ref := strings.TrimPrefix(spec, "%")
+	if id, err := strconv.Atoi(ref); err == nil {
+		job, ok := jobs[id]
+		if !ok {
+			return nil, fmt.Errorf("%s: no such job", spec)
+		}
+		return job, nil
+	}
+	if ref == spec || ref == "" {
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+
+	match := strings.HasPrefix
+	if sub, ok := strings.CutPrefix(ref, "?"); ok {
+		ref, match = sub, strings.Contains
+	}
+	var found *Job
+	for _, id := range sortedJobIDs() {
+		if match(jobs[id].Command, ref) {
+			if found != nil {
+				return nil, fmt.Errorf("%s: ambiguous job spec", spec)
+			}
+			found = jobs[id]
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+	return found, nil
+}
+
+// notifyJobs reports the background jobs that have finished since it was
+// last called, and forgets them.
+func (s *Shell) notifyJobs() {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	for _, id := range sortedJobIDs() {
+		if job := jobs[id]; job.finished() {
+			fmt.Fprintln(s.Stdout, job.line())
+			removeJob(id)
+		}
+	}
+}
+
+// sortedJobIDs returns the IDs of the jobs in order. The caller holds
+// jobsMutex.
+func sortedJobIDs() []int {
+	ids := make([]int, 0, len(jobs))
+	for id := range jobs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// handleJobs lists the jobs in order. With -l it also shows their process
+// IDs, one line for each process of a pipeline, and with -p it shows only
+// the process group of each, which kill can signal as a whole. -r lists
+// only running jobs and -s only stopped ones. Finished jobs are listed
+// once and then forgotten.
+func (s *Shell) handleJobs(args []string) error {
+	long, pidsOnly, asJSON := false, false, false
+	running, stopped := false, false
+	for _, arg := range args[1:] {
+		if arg == "--json" {
+			asJSON = true
+			continue
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			return usageError("jobs", arg+": invalid argument")
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'l':
+				long = true
+			case 'p':
+				pidsOnly = true
+			case 'r':
+				running = true
+			case 's':
+				stopped = true
+			default:
+				return invalidOption("jobs", "-"+string(c))
+			}
+		}
+	}
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	listed := []jobJSON{}
+	for _, id := range sortedJobIDs() {
+		job := jobs[id]
+		if running || stopped {
+			isRunning := !job.finished() && !job.Stopped
+			isStopped := !job.finished() && job.Stopped
+			if !(running && isRunning || stopped && isStopped) {
+				continue
+			}
+		}
+		if asJSON {
+			listed = append(listed, newJobJSON(job))
+			continue
+		}
+		if pidsOnly {
+			pgid := job.Pgid
+			if pgid == 0 {
+				pgid = job.PID
+			}
+			fmt.Fprintln(s.Stdout, pgid)
+			continue
+		}
+		if !long || len(job.PIDs) == 0 {
+			fmt.Fprintln(s.Stdout, job.line())
+		} else {
+			fmt.Fprintf(s.Stdout, "[%d]%c  %d %s\t%s\n", id, jobMarker(id), job.PIDs[0], job.state(), job.Command)
+			for _, pid := range job.PIDs[1:] {
+				fmt.Fprintf(s.Stdout, "      %d\n", pid)
+			}
+		}
+	}
+	for _, id := range sortedJobIDs() {
+		if jobs[id].finished() {
+			removeJob(id)
+		}
+	}
+
+	if asJSON {
+		return writeJSON(s.Stdout, listed)
+	}
+	return nil
+}
+
+// handleFg brings a job to the foreground: it gives the job the terminal,
+// continues it if it is stopped and waits for it to finish, taking on its
+// exit status.
+func (s *Shell) handleFg(args []string) error {
+	if len(args) > 2 {
+		return usageError("fg", "")
+	}
+	if s.subshell {
+		return errors.New("fg: no job control")
+	}
+
+	jobsMutex.Lock()
+	job, err := resolveJobSpec(strings.Join(args[1:], ""))
+	if err != nil {
+		jobsMutex.Unlock()
+		return fmt.Errorf("fg: %w", err)
+	}
+	fmt.Fprintln(s.Stdout, job.Command)
+	makeCurrent(job)
+	if job.Pgid != 0 {
+		setForeground(job.Pgid)
+		defer setForeground(shellPgid)
+	}
+	if job.Stopped {
+		select {
+		case <-job.stopped:
+		default:
+		}
+		job.Stopped = false
+		job.signal(syscall.SIGCONT)
+	}
+	jobsMutex.Unlock()
+
+	return s.waitForeground(job)
+}
+
+// handleBg continues a stopped job in the background.
+func (s *Shell) handleBg(args []string) error {
+	if len(args) > 2 {
+		return usageError("bg", "")
+	}
+	if s.subshell {
+		return errors.New("bg: no job control")
+	}
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	job, err := resolveJobSpec(strings.Join(args[1:], ""))
+	if err != nil {
+		return fmt.Errorf("bg: %w", err)
+	}
+	if !job.Stopped {
+		return fmt.Errorf("bg: job %d already in background", job.ID)
+	}
+	if err := job.signal(syscall.SIGCONT); err != nil {
+		return fmt.Errorf("bg: %w", err)
+	}
+	job.Stopped = false
+	fmt.Fprintf(s.Stdout, "[%d]%c  %s &\n", job.ID, jobMarker(job.ID), job.Command)
+
+	return nil
+}
+
+// handleWait waits for the given jobs or processes to finish and takes on
+// the status of the last one, or waits for every running job with none.
+// With -n it waits for whichever running job finishes first, reports it
+// and takes on its status. Finished jobs are removed from the table.
+func (s *Shell) handleWait(args []string) error {
+	next := false
+	targets := args[1:]
+	if len(targets) > 0 && targets[0] == "-n" {
+		next = true
+		targets = targets[1:]
+	}
+	if len(targets) > 0 && strings.HasPrefix(targets[0], "-") {
+		return invalidOption("wait", targets[0])
+	}
+
+	jobsMutex.Lock()
+	var waiting []*Job
+	if len(targets) == 0 {
+		for _, id := range sortedJobIDs() {
+			if !jobs[id].Stopped && !jobs[id].inherited {
+				waiting = append(waiting, jobs[id])
+			}
+		}
+	}
+	for _, target := range targets {
+		job, err := waitTarget(target)
+		if err == nil && job.inherited && !job.finished() {
+			err = fmt.Errorf("%s: not a child of this shell", target)
+		}
+		if err != nil {
+			jobsMutex.Unlock()
+			return &statusError{status: 127, err: fmt.Errorf("wait: %w", err)}
+		}
+		waiting = append(waiting, job)
+	}
+	jobsMutex.Unlock()
+
+	if next {
+		if len(waiting) == 0 {
+			return silentStatus(127)
+		}
+		cases := make([]reflect.SelectCase, len(waiting))
+		for i, job := range waiting {
+			cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(job.done)}
+		}
+		i, _, _ := reflect.Select(cases)
+		waiting = waiting[i : i+1]
+	}
+
+	status := 0
+	for _, job := range waiting {
+		<-job.done
+		status = exitStatus(job.err)
+
+		// A job killed by a signal is reported, unless that was done
+		// when it was removed from the table
+		jobsMutex.Lock()
+		if jobs[job.ID] == job {
+			var waitErr *waitError
+			if next || errors.As(job.err, &waitErr) && waitErr.status.Signaled() {
+				fmt.Fprintln(s.Stdout, job.line())
+			}
+			removeJob(job.ID)
+		}
+		delete(finishedJobs, job.ID)
+		jobsMutex.Unlock()
+	}
+
+	if status != 0 {
+		return silentStatus(status)
+	}
+	return nil
+}
+
+// waitTarget returns the job named by a %job argument, or the job a
+// process ID belongs to, including finished jobs that have not been waited
+// for. The caller holds jobsMutex.
+func waitTarget(target string) (*Job, error) {
+	if strings.HasPrefix(target, "%") {
+		job, err := resolveJobSpec(target)
+		if err != nil {
+			if id, convErr := strconv.Atoi(target[1:]); convErr == nil && finishedJobs[id] != nil {
+				return finishedJobs[id], nil
+			}
+		}
+		return job, err
+	}
+
+	pid, err := strconv.Atoi(target)
+	if err != nil {
+		return nil, fmt.Errorf("`%s': not a pid or valid job spec", target)
+	}
+	for _, table := range []map[int]*Job{jobs, finishedJobs} {
+		for _, job := range table {
+			for _, p := range job.PIDs {
+				if p == pid {
+					return job, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("pid %d is not a child of this shell", pid)
+}
+
+// handleKill implements `kill [-s sig | -sig] pid|%job...`, sending the
+// signal, SIGTERM by default, to each process, or to every process of each
+// job. The signal can be given by name, with or without SIG, or number.
+// kill -l lists the signals, or converts the numbers and names given.
+func (s *Shell) handleKill(args []string) error {
+	sig := syscall.SIGTERM
+	targets := args[1:]
+	if len(targets) > 0 && targets[0] == "-l" {
+		return s.killList(targets[1:])
+	}
+	if len(targets) > 0 && len(targets[0]) > 1 && targets[0][0] == '-' && targets[0] != "--" {
+		spec := targets[0][1:]
+		targets = targets[1:]
+		if spec == "s" {
+			if len(targets) == 0 {
+				return usageError("kill", "-s: option requires an argument")
+			}
+			spec, targets = targets[0], targets[1:]
+		}
+		var ok bool
+		if sig, ok = signalByName(spec); !ok {
+			return usageError("kill", spec+": invalid signal specification")
+		}
+	}
+	if len(targets) > 0 && targets[0] == "--" {
+		targets = targets[1:]
+	}
+	if len(targets) == 0 {
+		return usageError("kill", "")
+	}
+
+	var result error
+	for _, target := range targets {
+		var err error
+		if strings.HasPrefix(target, "%") {
+			jobsMutex.Lock()
+			var job *Job
+			if job, err = resolveJobSpec(target); err == nil {
+				if err = job.signal(sig); err == nil && sig == syscall.SIGCONT {
+					job.Stopped = false
+				}
+			}
+			jobsMutex.Unlock()
+		} else if pid, convErr := strconv.Atoi(target); convErr != nil {
+			err = fmt.Errorf("%s: arguments must be process or job IDs", target)
+		} else {
+			if err = syscall.Kill(pid, sig); err != nil {
+				err = fmt.Errorf("(%d) - %w", pid, err)
+			}
+		}
+
+		if err != nil {
+			fmt.Fprintf(s.Stderr, "kill: %v\n", err)
+			result = silentStatus(1)
+		}
+	}
+
+	return result
+}
+
+// killList implements kill -l: with no arguments it lists the signals,
+// otherwise it prints the name of each signal number, or the number of
+// each name. A number over 128 is taken as the exit status of a command
+// killed by that signal less 128.
+func (s *Shell) killList(specs []string) error {
+	if len(specs) == 0 {
+		listSignals(s.Stdout)
+		return nil
+	}
+
+	var result error
+	for _, spec := range specs {
+		n, err := strconv.Atoi(spec)
+		if err == nil && n > 128 {
+			n -= 128
+		}
+		sig, ok := signalByName(spec)
+		if err == nil {
+			sig, ok = syscall.Signal(n), nameBySignal(syscall.Signal(n)) != ""
+		}
+		switch {
+		case !ok:
+			fmt.Fprintf(s.Stderr, "kill: %s: invalid signal specification\n", spec)
+			result = silentStatus(1)
+		case err == nil:
+			fmt.Fprintln(s.Stdout, nameBySignal(sig))
+		default:
+			fmt.Fprintln(s.Stdout, int(sig))
+		}
+	}
+
+	return result
+}
+
+// handleSuspend stops the shell until it gets SIGCONT, typically from the
+// fg of the shell that started it. A login shell has no such parent, so
+// it is only suspended with -f.
+func (s *Shell) handleSuspend(args []string) error {
+	force := false
+	for _, arg := range args[1:] {
+		if arg != "-f" {
+			return invalidOption("suspend", arg)
+		}
+		force = true
+	}
+
+	if isLoginShell() && !force {
+		return errors.New("suspend: cannot suspend a login shell")
+	}
+
+	return syscall.Kill(-syscall.Getpgrp(), syscall.SIGSTOP)
+}
+
+// isLoginShell reports whether the shell was started as a login shell,
+// which login and sshd signal with a leading '-' in its name.
+func isLoginShell() bool {
+	return strings.HasPrefix(os.Args[0], "-")
+}
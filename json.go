@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// jobJSON is a job as jobs --json lists it.
+type jobJSON struct {
+	ID      int    `json:"id"`
+	PID     int    `json:"pid"`
+	PIDs    []int  `json:"pids"`
+	Pgid    int    `json:"pgid"`
+	Command string `json:"command"`
+	Status  string `json:"status"`
+}
+
+// historyJSON is a history entry as history --json lists it.
+type historyJSON struct {
+	Number  int    `json:"number"`
+	Command string `json:"command"`
+}
+
+// newJobJSON describes job for jobs --json. The caller holds jobsMutex.
+func newJobJSON(job *Job) jobJSON {
+	pids := job.PIDs
+	if pids == nil {
+		pids = []int{}
+	}
+	return jobJSON{
+		ID:      job.ID,
+		PID:     job.PID,
+		PIDs:    pids,
+		Pgid:    job.Pgid,
+		Command: job.Command,
+		Status:  job.state(),
+	}
+}
+
+// writeJSON writes v to w as indented JSON, for the --json output of
+// builtins that tools read rather than people.
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -16,11 +18,66 @@ import (
 	"syscall"
 )
 
-type Job struct {
-	ID      int
-	PID     int
-	Command string
-	Stopped bool
+// Shell executes command lines against its own standard streams, so the
+// output of builtins and external commands can be captured by embedders.
+type Shell struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	lastStatus int
+
+	// substStatus is the status of the last command substitution run
+	// while parsing the current command.
+	substStatus int
+
+	// interactive is set for the shell reading commands from the user.
+	interactive bool
+
+	// subshell is set in the shell process started to run a pipeline
+	// builtin or a command substitution.
+	subshell bool
+
+	// scriptName and scriptLine locate the line being run from a script or
+	// sourced file, so errors can say where they happened.
+	scriptName string
+	scriptLine int
+
+	// activeAliases holds the aliases being expanded as command lines.
+	activeAliases map[string]bool
+
+	// nextLine reads the next line of input after the current command
+	// line, for here-document bodies. It reports false at the end of the
+	// input, and is nil when there is nothing more to read.
+	nextLine func() (string, bool)
+
+	// pendingHereDocs holds here-documents already read for a command line
+	// that is being run again as the value of an alias.
+	pendingHereDocs []*hereDoc
+
+	// exitWarned is set when exit has been refused because of jobs that
+	// are still running, so that exit as the next command line goes ahead.
+	exitWarned bool
+
+	// params are the positional parameters, $1 onwards: the arguments of
+	// the script, or those given to set --.
+	params []string
+
+	// extraFDs are descriptors 3 and up, opened with exec.
+	extraFDs map[int]*os.File
+
+	// coprocs are the coprocesses whose pipes are among extraFDs.
+	coprocs []*coproc
+
+	// lastArg is $_: the last argument of the previous simple command, or
+	// to begin with the path of the shell.
+	lastArg string
+
+	// errexitFailed is set when, with errexit, a command fails that is
+	// not exempt from it as those before the last of an && or || list
+	// are. errexitExempt counts the lists whose left side is running.
+	errexitFailed bool
+	errexitExempt int
 }
 
 var (
@@ -31,35 +88,260 @@ var (
 	aliases    = make(map[string]string)
 )
 
+// NewShell returns a Shell bound to the process's standard streams.
+func NewShell() *Shell {
+	return &Shell{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}
+}
+
+// Run executes a command line, returning what it wrote to stdout and stderr
+// along with its exit status.
+func (s *Shell) Run(line string) (string, string, int, error) {
+	var outBuf, errBuf bytes.Buffer
+	origOut, origErr := s.Stdout, s.Stderr
+	s.Stdout = &syncWriter{w: &outBuf}
+	s.Stderr = &syncWriter{w: &errBuf}
+	defer func() {
+		s.Stdout, s.Stderr = origOut, origErr
+	}()
+
+	err := s.execInput(line)
+	return outBuf.String(), errBuf.String(), s.lastStatus, err
+}
+
+// syncWriter serializes writes from the several processes of a pipeline
+// that share one capture buffer.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Write(p)
+}
+
+// exitStatus maps the result of running a command to its exit status. A
+// command killed by a signal has the status 128 plus the signal's number.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var waitErr *waitError
+	if errors.As(err, &waitErr) {
+		return waitStatus(waitErr.status)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return waitStatus(ws)
+		}
+		return exitErr.ExitCode()
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status
+	}
+	return 1
+}
+
+// exitedNonzero reports whether err is only that of a command that exited
+// with a nonzero status, which is not worth reporting, rather than one
+// killed by a signal.
+func exitedNonzero(err error) bool {
+	var waitErr *waitError
+	if errors.As(err, &waitErr) {
+		return waitErr.status.Exited()
+	}
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.Exited()
+}
+
+// waitStatus is the exit status of a process that ended with ws.
+func waitStatus(ws syscall.WaitStatus) int {
+	if ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ws.ExitStatus()
+}
+
 func main() {
+	if v := os.Getenv("GOSH_DEBUG"); v != "" && v != "0" {
+		enableDebug()
+	}
+	if fd := os.Getenv(subshellEnv); fd != "" {
+		runSubshell(fd)
+	}
 	setupSignalHandlers()
-	loadHistory()
+	initEnvironment()
 	loadAliases()
 
+	s := NewShell()
+	s.lastArg, _ = os.Executable()
+
+	// Commands are read from stdin unless --input names a file or FIFO
+	// for another program to write them to, which is run as a script is
+	inputPath := ""
+
+	args := os.Args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		flag := args[0]
+		args = args[1:]
+		if flag == "--" {
+			break
+		}
+
+		switch flag {
+		case "--debug":
+			enableDebug()
+		case "--version":
+			fmt.Print(versionInfo())
+			os.Exit(0)
+		case "--input":
+			if len(args) == 0 {
+				fmt.Fprintln(os.Stderr, "--input: option requires an argument")
+				os.Exit(2)
+			}
+			inputPath, args = args[0], args[1:]
+		default:
+			fmt.Fprintf(os.Stderr, "%s: invalid option\n", flag)
+			fmt.Fprintln(os.Stderr, "usage: shell-fs [--debug] [--version] [--input path] [script [arg ...]]")
+			os.Exit(2)
+		}
+	}
+
+	if len(args) > 0 {
+		s.params = args[1:]
+		if err := s.execFile(args[0]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(127)
+		}
+		s.exit(s.lastStatus)
+	}
+	if inputPath != "" {
+		if err := s.execFile(inputPath); err != nil {
+			fmt.Fprintln(os.Stderr, "--input:", err)
+			os.Exit(1)
+		}
+		s.exit(s.lastStatus)
+	}
+
+	s.interactive = true
+	options.expandAliases = true
+	initJobControl()
+	loadHistory()
+	loadDirs()
+
 	reader := bufio.NewReader(os.Stdin)
+	s.nextLine = func() (string, bool) {
+		ps2, ok := findVar("PS2")
+		if !ok {
+			ps2 = "> "
+		}
+		fmt.Print(ps2)
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			return "", false
+		}
+		return strings.TrimSuffix(line, "\n"), true
+	}
 	for {
+		s.notifyJobs()
 		printPrompt()
 		input, err := reader.ReadString('\n')
 		if err != nil {
-			if err == io.EOF {
+			if errors.Is(err, io.EOF) {
 				fmt.Println("\nexit")
-				break
+				s.exit(s.lastStatus)
 			}
 			fmt.Fprintln(os.Stderr, "Error reading input:", err)
 			continue
 		}
 
-		input = strings.TrimSpace(input)
+		input = strings.TrimSpace(s.joinContinuations(strings.TrimSuffix(input, "\n")))
+
+		// Show the command a history reference expanded to before running
+		// it, and remember it in its expanded form. With :p it is only
+		// shown and remembered.
+		expanded, changed, printOnly, err := expandHistory(input)
+		if err != nil {
+			s.reportError(err)
+			continue
+		}
+		if changed {
+			input = expanded
+			fmt.Println(input)
+		}
+
 		if input != "" {
 			history = append(history, input)
 		}
+		if printOnly {
+			continue
+		}
 
-		if err = execInput(input); err != nil {
-			fmt.Fprintln(os.Stderr, "Error:", err)
+		warned := s.exitWarned
+		if err = s.execInput(input); err != nil {
+			s.reportError(err)
+		}
+		if warned {
+			s.exitWarned = false
 		}
 	}
+}
 
-	saveHistory()
+// exit runs the shell's shutdown steps and exits the process. Every way
+// out of the shell, the exit builtin included, goes through here.
+func (s *Shell) exit(status int) {
+	if s.interactive && !s.subshell {
+		saveHistory()
+		saveDirs()
+	}
+	os.Exit(status)
+}
+
+// defaultPath is used when the shell is started without a PATH, so that
+// external commands can still be found.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// initEnvironment adjusts the environment inherited from whatever started
+// the shell.
+func initEnvironment() {
+	// Programs that run $SHELL should get this shell; users can still
+	// export a different one.
+	if exe, err := os.Executable(); err == nil {
+		os.Setenv("SHELL", exe)
+	}
+
+	if os.Getenv("PATH") == "" {
+		os.Setenv("PATH", defaultPath)
+		fmt.Fprintf(os.Stderr, "PATH is not set; using %s\n", defaultPath)
+	}
+}
+
+// interrupts, while it is set, receives the SIGINTs the shell gets in
+// place of the usual reminder, for builtins such as watch that run until
+// interrupted. It is guarded by interruptsMu.
+var (
+	interruptsMu sync.Mutex
+	interrupts   chan struct{}
+)
+
+// catchInterrupts makes SIGINT stop the builtin that calls it rather than
+// print the reminder, until the returned function is called. That puts
+// back whatever caught them before, so a repeat run by watch leaves watch
+// catching them.
+func catchInterrupts() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	interruptsMu.Lock()
+	prev := interrupts
+	interrupts = ch
+	interruptsMu.Unlock()
+	return ch, func() {
+		interruptsMu.Lock()
+		interrupts = prev
+		interruptsMu.Unlock()
+	}
 }
 
 func setupSignalHandlers() {
@@ -70,6 +352,16 @@ func setupSignalHandlers() {
 		for sig := range sigChan {
 			switch sig {
 			case syscall.SIGINT:
+				interruptsMu.Lock()
+				ch := interrupts
+				interruptsMu.Unlock()
+				if ch != nil {
+					select {
+					case ch <- struct{}{}:
+					default:
+					}
+					continue
+				}
 				fmt.Println("\n(Use 'exit' to quit)")
 				printPrompt()
 			case syscall.SIGTSTP:
@@ -87,10 +379,7 @@ func printPrompt() {
 		return
 	}
 
-	home, _ := os.UserHomeDir()
-	if home != "" && strings.HasPrefix(cwd, home) {
-		cwd = "~" + strings.TrimPrefix(cwd, home)
-	}
+	cwd = abbreviateHome(cwd)
 
 	currentUser, err := user.Current()
 	username := "user"
@@ -101,37 +390,203 @@ func printPrompt() {
 	fmt.Printf("\033[32m%s\033[0m:\033[34m%s\033[0m$ ", username, filepath.Base(cwd))
 }
 
-func execInput(input string) error {
-	input = strings.TrimSpace(input)
+// execInput parses and runs a line of input. A command that failed only
+// with its status, reported already if at all, is not returned as an error.
+func (s *Shell) execInput(input string) error {
+	s.closeCoprocs()
+	input = strings.TrimSpace(stripComment(input))
 
-	if input == "" || strings.HasPrefix(input, "#") {
+	if input == "" {
 		return nil
 	}
 
-	// Check for background job
-	background := strings.HasSuffix(input, "&")
-	if background {
-		input = strings.TrimSuffix(input, "&")
-		input = strings.TrimSpace(input)
+	tree, err := parseLine(input)
+	if err == nil {
+		err = s.readHereDocs(tree)
+	}
+	if err != nil {
+		s.lastStatus = 2
+		s.checkErrexit()
+		return err
+	}
+
+	if err = s.execNode(tree); errors.Is(err, errSilent) {
+		return nil
+	}
+	return err
+}
+
+// execNested runs line on behalf of a command, such as an alias, that
+// fails with whatever status line leaves, reported or not.
+func (s *Shell) execNested(line string) error {
+	err := s.execInput(line)
+	if err == nil && s.lastStatus != 0 {
+		return silentStatus(s.lastStatus)
+	}
+	return err
+}
+
+// reportError prints an error from a command whose failure does not stop
+// the rest of the command line.
+func (s *Shell) reportError(err error) {
+	if errors.Is(err, errSilent) {
+		return
+	}
+	if s.scriptName != "" {
+		fmt.Fprintf(s.Stderr, "%s: line %d: %v\n", s.scriptName, s.scriptLine, err)
+		return
+	}
+	fmt.Fprintln(s.Stderr, "Error:", err)
+}
+
+// execFile runs each line of the named file in the current shell. Errors
+// are reported with the file name and line number and do not stop the
+// rest of the file, unless errexit is set and the line fails.
+func (s *Shell) execFile(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	prevName, prevLine := s.scriptName, s.scriptLine
+	defer func() {
+		s.scriptName, s.scriptLine = prevName, prevLine
+	}()
+	s.scriptName = name
+
+	scanner := bufio.NewScanner(file)
+	prevNext := s.nextLine
+	defer func() { s.nextLine = prevNext }()
+	s.nextLine = func() (string, bool) {
+		if !scanner.Scan() {
+			return "", false
+		}
+		s.scriptLine++
+		return scanner.Text(), true
+	}
+
+	for s.scriptLine = 1; scanner.Scan(); s.scriptLine++ {
+		s.errexitFailed = false
+		if err := s.execInput(s.joinContinuations(scanner.Text())); err != nil {
+			s.reportError(err)
+		}
+		if s.errexitFailed {
+			s.errexitFailed = false
+			s.reportError(fmt.Errorf("errexit: stopping after status %d", s.lastStatus))
+			return nil
+		}
 	}
 
-	// Split by pipes
-	commands := splitByPipes(input)
+	return scanner.Err()
+}
+
+// execNode runs a parsed command line, short-circuiting && and || on the
+// status of their left-hand side.
+func (s *Shell) execNode(n node) error {
+	switch n := n.(type) {
+	case *pipelineNode:
+		debugf("pipeline %q background=%t", n.commands, n.background)
+		if n.timed {
+			defer s.reportTime(startTiming(), n.posixTime)
+		}
+		var err error
+		if len(n.commands) == 1 {
+			err = s.execSingleCommand(n.commands[0], n.hereDocs[0], n.background)
+		} else {
+			err = s.execPipeline(n.commands, n.hereDocs, n.background)
+		}
+		s.lastStatus = exitStatus(err)
+		s.checkErrexit()
+		if exitedNonzero(err) {
+			return silentStatus(s.lastStatus)
+		}
+		return err
+	case *listNode:
+		// Only the last command of an && or || list can trip errexit
+		andOr := n.op == "&&" || n.op == "||"
+		if andOr {
+			s.errexitExempt++
+		}
+		err := s.execNode(n.left)
+		if andOr {
+			s.errexitExempt--
+		}
+		if s.errexitFailed {
+			return err
+		}
+		if (n.op == "&&" && s.lastStatus != 0) || (n.op == "||" && s.lastStatus == 0) {
+			debugf("%s: skipping right side after status %d", n.op, s.lastStatus)
+			return err
+		}
+		if err != nil {
+			s.reportError(err)
+		}
+		return s.execNode(n.right)
+	}
+	return nil
+}
 
-	if len(commands) == 1 {
-		return execSingleCommand(commands[0], background)
+// checkErrexit notes a failed command that stops the script or sourced
+// file running it, if errexit is set and the command is not exempt.
+func (s *Shell) checkErrexit() {
+	if options.errexit && s.lastStatus != 0 && s.errexitExempt == 0 && s.scriptName != "" {
+		s.errexitFailed = true
 	}
+}
+
+// node is a parsed command line: either a pipeline or a list joining two
+// nodes with a control operator.
+type node interface{}
+
+type pipelineNode struct {
+	commands []string
+	// hereDocs holds the here-documents of each command, once read
+	hereDocs   [][]*hereDoc
+	background bool
+	// timed is set for a pipeline after the time keyword, and posixTime
+	// for time -p.
+	timed, posixTime bool
+}
+
+type listNode struct {
+	op          string // "&&", "||" or ";"
+	left, right node
+}
 
-	return execPipeline(commands, background)
+// lineToken is either a run of command text or a control operator.
+type lineToken struct {
+	op   string
+	text string
 }
 
-func splitByPipes(input string) []string {
-	var commands []string
+// lexLine splits input into command text and the control operators |, &&,
+// ||, ; and & that separate it. Operators inside quotes or command
+// substitutions, and the & of >& and <&, are left as text.
+func lexLine(input string) []lineToken {
+	var tokens []lineToken
 	var current strings.Builder
 	inQuote := false
 	quoteChar := rune(0)
+	runes := []rune(input)
+
+	flush := func() {
+		if text := strings.TrimSpace(current.String()); text != "" {
+			tokens = append(tokens, lineToken{text: text})
+		}
+		current.Reset()
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		if r == '\\' && quoteChar != '\'' && i+1 < len(runes) {
+			current.WriteRune(r)
+			current.WriteRune(runes[i+1])
+			i++
+			continue
+		}
 
-	for _, r := range input {
 		if r == '"' || r == '\'' {
 			if inQuote && r == quoteChar {
 				inQuote = false
@@ -140,381 +595,1322 @@ func splitByPipes(input string) []string {
 				quoteChar = r
 			}
 			current.WriteRune(r)
-		} else if r == '|' && !inQuote {
-			commands = append(commands, strings.TrimSpace(current.String()))
-			current.Reset()
-		} else {
+			continue
+		}
+
+		// A command substitution is copied whole, operators and all
+		if !inQuote || quoteChar == '"' {
+			end := -1
+			if r == '$' && i+1 < len(runes) && runes[i+1] == '(' {
+				if n := matchParen(runes[i+1:]); n >= 0 {
+					end = i + 1 + n
+				}
+			} else if r == '`' {
+				for j := i + 1; j < len(runes); j++ {
+					if runes[j] == '\\' {
+						j++
+					} else if runes[j] == '`' {
+						end = j
+						break
+					}
+				}
+			}
+			if end >= 0 {
+				current.WriteString(string(runes[i : end+1]))
+				i = end
+				continue
+			}
+		}
+
+		// The & of the redirections >&N and <&N is not an operator
+		isDup := r == '&' && i > 0 && (runes[i-1] == '>' || runes[i-1] == '<')
+		if inQuote || isDup || (r != '|' && r != '&' && r != ';') {
 			current.WriteRune(r)
+			continue
 		}
+
+		op := string(r)
+		if r != ';' && i+1 < len(runes) && runes[i+1] == r {
+			op += string(r)
+			i++
+		}
+		flush()
+		tokens = append(tokens, lineToken{op: op})
 	}
+	flush()
+
+	return tokens
+}
+
+// lineParser builds a command tree from the tokens of one command line.
+// Pipelines bind tightest, then && and || with equal precedence, then ;
+// and &; all operators associate to the left.
+type lineParser struct {
+	tokens []lineToken
+	pos    int
+}
+
+func parseLine(input string) (node, error) {
+	p := &lineParser{tokens: lexLine(input)}
+	return p.parseList()
+}
 
-	if current.Len() > 0 {
-		commands = append(commands, strings.TrimSpace(current.String()))
+// peekOp returns the operator at the current position, or "" if the
+// parser is at command text or the end of the line.
+func (p *lineParser) peekOp() string {
+	if p.pos >= len(p.tokens) {
+		return ""
 	}
+	return p.tokens[p.pos].op
+}
+
+func (p *lineParser) atText() bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].op == ""
+}
 
-	return commands
+func (p *lineParser) syntaxError() error {
+	if p.pos >= len(p.tokens) {
+		return errors.New("syntax error: unexpected end of input")
+	}
+	return fmt.Errorf("syntax error near unexpected token `%s'", p.tokens[p.pos].op)
 }
 
-func execSingleCommand(cmdStr string, background bool) error {
-	args, inputFile, outputFile, appendMode, err := parseCommand(cmdStr)
+func (p *lineParser) parseList() (node, error) {
+	var list node
+
+	for p.pos < len(p.tokens) {
+		n, err := p.parseAndOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if op := p.peekOp(); op == ";" || op == "&" {
+			p.pos++
+			if op == "&" {
+				pl, ok := n.(*pipelineNode)
+				if !ok {
+					return nil, errors.New("background lists are not supported")
+				}
+				pl.background = true
+			}
+		} else if p.pos < len(p.tokens) {
+			return nil, p.syntaxError()
+		}
+
+		if list == nil {
+			list = n
+		} else {
+			list = &listNode{op: ";", left: list, right: n}
+		}
+	}
+
+	return list, nil
+}
+
+func (p *lineParser) parseAndOr() (node, error) {
+	left, err := p.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+
+	for op := p.peekOp(); op == "&&" || op == "||"; op = p.peekOp() {
+		p.pos++
+		right, err := p.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		left = &listNode{op: op, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// parsePipeline reads commands separated by |. Every pipe must have a
+// command on both sides, so "| ls", "ls |" and "ls | | wc" are rejected.
+func (p *lineParser) parsePipeline() (node, error) {
+	pl := &pipelineNode{}
+
+	// time times the whole pipeline, and on its own, nothing at all
+	if p.atText() {
+		if rest, ok := cutKeyword(p.tokens[p.pos].text, "time"); ok {
+			pl.timed = true
+			if after, ok := cutKeyword(rest, "-p"); ok {
+				rest, pl.posixTime = after, true
+			}
+			p.tokens[p.pos].text = rest
+			if rest == "" {
+				p.pos++
+				if p.peekOp() == "|" {
+					return nil, p.syntaxError()
+				}
+				return pl, nil
+			}
+		}
+	}
+
+	for {
+		if !p.atText() {
+			if p.pos > 0 && p.tokens[p.pos-1].op == "|" {
+				p.pos--
+			}
+			return nil, p.syntaxError()
+		}
+		pl.commands = append(pl.commands, p.tokens[p.pos].text)
+		p.pos++
+
+		if p.peekOp() != "|" {
+			break
+		}
+		p.pos++
+	}
+
+	return pl, nil
+}
+
+// cutKeyword returns what follows the word keyword at the start of text,
+// and whether it is there. The keyword must be a word of its own.
+func cutKeyword(text, keyword string) (string, bool) {
+	rest, ok := strings.CutPrefix(text, keyword)
+	if !ok || rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+		return text, false
+	}
+	return strings.TrimLeft(rest, " \t"), true
+}
+
+func (s *Shell) execSingleCommand(cmdStr string, docs []*hereDoc, background bool) error {
+	// An alias whose value is a command line of its own, with pipes,
+	// lists or redirections, is substituted into the text and the result
+	// run as a whole line. While it runs the alias is not expanded again,
+	// so an alias that refers to itself cannot recurse forever.
+	if name, rest, _ := strings.Cut(cmdStr, " "); options.expandAliases && !s.activeAliases[name] {
+		if value, ok := aliases[name]; ok && strings.ContainsAny(value, "|&;<>") {
+			if s.activeAliases == nil {
+				s.activeAliases = make(map[string]bool)
+			}
+			s.activeAliases[name] = true
+			defer delete(s.activeAliases, name)
+
+			line := value + " " + rest
+			if background {
+				line += " &"
+			}
+			debugf("alias %s: running line %q", name, line)
+			s.pendingHereDocs = docs
+			defer func() { s.pendingHereDocs = nil }()
+			return s.execNested(line)
+		}
+	}
+
+	cmd, err := s.parseCommand(cmdStr, docs)
 	if err != nil {
 		return err
 	}
 
+	return s.runCommand(cmd, background)
+}
+
+// aliasWords expands the alias that is cmd's name and, as long as the
+// value of one ends in a space, as in alias sudo='sudo ', the word after
+// it too. Each alias is expanded at most once, so that aliases naming each
+// other stop.
+func (s *Shell) aliasWords(cmd *simpleCommand) []string {
+	var args []string
+	seen := make(map[string]bool)
+	i := 0
+	for i < len(cmd.args) {
+		word := cmd.args[i]
+		_, ok := aliases[word]
+		if !ok || seen[word] || s.activeAliases[word] || i < len(cmd.argQuoted) && cmd.argQuoted[i] ||
+			i < len(cmd.argLiteral) && !cmd.argLiteral[i] {
+			break
+		}
+		words, blank := s.expandAlias(word, seen)
+		args = append(args, words...)
+		i++
+		if !blank {
+			break
+		}
+	}
+	return append(args, cmd.args[i:]...)
+}
+
+// expandAlias returns the words of the alias name, whose first word is
+// expanded in turn if it is an alias not yet in seen, and whether the
+// value, or that of an alias it ends with, ends in a blank.
+func (s *Shell) expandAlias(name string, seen map[string]bool) ([]string, bool) {
+	seen[name] = true
+	value := aliases[name]
+	words := strings.Fields(value)
+	blank := strings.HasSuffix(value, " ") || strings.HasSuffix(value, "\t")
+	if len(words) == 0 {
+		return words, blank
+	}
+	if _, ok := aliases[words[0]]; !ok || seen[words[0]] || s.activeAliases[words[0]] {
+		return words, blank
+	}
+
+	first, firstBlank := s.expandAlias(words[0], seen)
+	if len(words) == 1 {
+		blank = blank || firstBlank
+	}
+	return append(first, words[1:]...), blank
+}
+
+// expandsAlias reports whether cmd's name is an alias to expand: aliases
+// are enabled with expand_aliases, the name was not quoted, and it is not
+// already being expanded.
+func (s *Shell) expandsAlias(cmd *simpleCommand) bool {
+	if len(cmd.args) == 0 || !options.expandAliases || cmd.nameQuoted || s.activeAliases[cmd.args[0]] {
+		return false
+	}
+	_, ok := aliases[cmd.args[0]]
+	return ok
+}
+
+// runCommand runs a parsed command as an alias, builtin or external
+// program.
+func (s *Shell) runCommand(cmd *simpleCommand, background bool) error {
+	args := cmd.args
 	if len(args) == 0 {
+		// Assignments alone set shell variables. The status is that of
+		// the last command substitution in them, if any.
+		for _, word := range cmd.assigns {
+			if err := assign(word); err != nil {
+				return err
+			}
+		}
+		for _, array := range cmd.arrays {
+			if _, ok := assocVars[array.name]; ok {
+				if err := setAssoc(array.name, array.values); err != nil {
+					return err
+				}
+				continue
+			}
+			setArray(array.name, array.values)
+		}
+		if s.substStatus != 0 {
+			return silentStatus(s.substStatus)
+		}
 		return nil
 	}
 
-	// Expand aliases
-	if alias, ok := aliases[args[0]]; ok {
-		aliasArgs := strings.Fields(alias)
-		args = append(aliasArgs, args[1:]...)
+	// $_ is the last argument, once the words have all been expanded
+	s.lastArg = args[len(args)-1]
+
+	// Assignments before a command name only go into its environment
+	for _, assign := range cmd.assigns {
+		name, value, _ := strings.Cut(assign, "=")
+		if !isValidName(name) {
+			continue
+		}
+		prev, had := os.LookupEnv(name)
+		os.Setenv(name, value)
+		defer func() {
+			if had {
+				os.Setenv(name, prev)
+			} else {
+				os.Unsetenv(name)
+			}
+		}()
 	}
 
-	// Handle built-in commands
-	switch args[0] {
-	case "cd":
-		return handleCD(args)
-	case "exit":
-		os.Exit(0)
-	case "pwd":
-		cwd, err := os.Getwd()
-		if err != nil {
-			return err
+	// Expand aliases, if enabled with expand_aliases, unless the name was
+	// quoted
+	if s.expandsAlias(cmd) {
+		args = s.aliasWords(cmd)
+		debugf("alias %s: args %q", cmd.args[0], args)
+	}
+
+	// exec without a command keeps its redirections for the shell
+	if args[0] == "exec" && len(args) == 1 {
+		return s.redirectShell(cmd.redirs)
+	}
+
+	if handler, ok := builtins[args[0]]; ok {
+		debugf("builtin %q", args)
+		// Without redirections the builtin works on the shell's own
+		// descriptors, so those it opens, as coproc does, stay open
+		if len(cmd.redirs) > 0 {
+			table, files, err := s.fds().apply(cmd.redirs)
+			if err != nil {
+				return err
+			}
+			defer closeFiles(files)
+
+			orig := s.fds()
+			s.Stdin, s.Stdout, s.Stderr, s.extraFDs = table.stdin, table.stdout, table.stderr, table.extra
+			defer func() {
+				s.Stdin, s.Stdout, s.Stderr, s.extraFDs = orig.stdin, orig.stdout, orig.stderr, orig.extra
+			}()
+		}
+		if s.shouldPage(args[0]) {
+			return s.runPaged(handler, args)
+		}
+		return handler(s, args)
+	}
+
+	// With autocd, a directory name that is not also a command means cd
+	if options.autocd {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			if info, err := os.Stat(args[0]); err == nil && info.IsDir() {
+				return s.handleCD(append([]string{"cd"}, args...))
+			}
 		}
-		fmt.Println(cwd)
-		return nil
-	case "export":
-		return handleExport(args)
-	case "echo":
-		output := strings.Join(args[1:], " ")
-		if outputFile != "" {
-			return writeToFile(output, outputFile, appendMode)
-		}
-		fmt.Println(output)
-		return nil
-	case "history":
-		return handleHistory(args)
-	case "alias":
-		return handleAlias(args)
-	case "unalias":
-		return handleUnalias(args)
-	case "jobs":
-		return handleJobs()
-	case "fg":
-		return handleFg(args)
-	case "bg":
-		return handleBg(args)
 	}
 
-	return execExternal(args, inputFile, outputFile, appendMode, background)
+	// With correct, offer to run the command the name is a typo of
+	if options.correct {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			if name, ok := correctionFor(args[0]); ok {
+				answer, err := readTerminalLine(fmt.Sprintf("Did you mean '%s'? [y/N] ", name))
+				if err == nil && strings.EqualFold(answer, "y") {
+					corrected := *cmd
+					corrected.assigns = nil
+					corrected.args = append([]string{name}, args[1:]...)
+					return s.runCommand(&corrected, background)
+				}
+			}
+		}
+	}
+
+	return s.execExternal(args, cmd, background)
 }
 
-func parseCommand(cmdStr string) ([]string, string, string, bool, error) {
-	var args []string
+// builtins maps each builtin command to its handler. The error a handler
+// returns becomes the command's exit status through exitStatus: nil is 0,
+// a usage error (bad or missing arguments) is 2, and any other failure is
+// 1. Commands that are not found exit with 127.
+var builtins map[string]func(*Shell, []string) error
+
+func init() {
+	builtins = map[string]func(*Shell, []string) error{
+		"cd":        (*Shell).handleCD,
+		"pushd":     (*Shell).handlePushd,
+		"popd":      (*Shell).handlePopd,
+		"dirs":      (*Shell).handleDirs,
+		"exit":      (*Shell).handleExit,
+		"pwd":       (*Shell).handlePwd,
+		"export":    (*Shell).handleExport,
+		"echo":      (*Shell).handleEcho,
+		"exec":      (*Shell).handleExec,
+		"printf":    (*Shell).handlePrintf,
+		"history":   (*Shell).handleHistory,
+		"alias":     (*Shell).handleAlias,
+		"unalias":   (*Shell).handleUnalias,
+		"jobs":      (*Shell).handleJobs,
+		"fg":        (*Shell).handleFg,
+		"bg":        (*Shell).handleBg,
+		"coproc":    (*Shell).handleCoproc,
+		"kill":      (*Shell).handleKill,
+		"wait":      (*Shell).handleWait,
+		"suspend":   (*Shell).handleSuspend,
+		"source":    (*Shell).handleSource,
+		".":         (*Shell).handleSource,
+		"tee":       (*Shell).handleTee,
+		"confirm":   (*Shell).handleConfirm,
+		"umask":     (*Shell).handleUmask,
+		"ulimit":    (*Shell).handleUlimit,
+		"set":       (*Shell).handleSet,
+		"shopt":     (*Shell).handleShopt,
+		"version":   (*Shell).handleVersion,
+		"mapfile":   (*Shell).handleMapfile,
+		"declare":   (*Shell).handleDeclare,
+		"times":     (*Shell).handleTimes,
+		"type":      (*Shell).handleType,
+		"id":        (*Shell).handleID,
+		"timeout":   (*Shell).handleTimeout,
+		"repeat":    (*Shell).handleRepeat,
+		"watch":     (*Shell).handleWatch,
+		"readarray": (*Shell).handleMapfile,
+		"help":      (*Shell).handleHelp,
+		"shift":     (*Shell).handleShift,
+
+		"history-search": (*Shell).handleHistorySearch,
+	}
+}
+
+// statusError is a command failure with a specific exit status.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// errSilent is wrapped by failures that have already been reported, or
+// that only need to set the exit status.
+var errSilent = errors.New("command failed")
+
+// silentStatus fails a command with status without printing anything.
+func silentStatus(status int) error {
+	return &statusError{status: status, err: errSilent}
+}
+
+// usageErrorf reports a builtin invoked with bad arguments.
+func usageErrorf(format string, a ...any) error {
+	return &statusError{status: 2, err: fmt.Errorf(format, a...)}
+}
+
+// notFoundError reports a command that is neither a builtin nor on PATH,
+// suggesting similarly named commands if there are any.
+func notFoundError(name string) error {
+	msg := name + ": command not found"
+	if suggestions := suggestCommands(name); len(suggestions) > 0 {
+		msg += ". Did you mean " + strings.Join(suggestions, ", ") + "?"
+	}
+	return &statusError{status: 127, err: errors.New(msg)}
+}
+
+// simpleCommand is a command line without control operators, split into
+// its words and redirections.
+type simpleCommand struct {
+	// assigns are the NAME=value words before the command name, and
+	// arrays the NAME=(...) ones
+	assigns []string
+	arrays  []arrayAssign
+	args    []string
+	// nameQuoted is set if any of the command name was quoted or escaped,
+	// as in \ls, which keeps it from being expanded as an alias.
+	nameQuoted bool
+	// argQuoted records which of args were quoted or escaped, so that
+	// those are not expanded after an alias ending in a space either, and
+	// argLiteral which were written as they are, with no expansion or
+	// glob, as only those can be aliases.
+	argQuoted  []bool
+	argLiteral []bool
+	// redirs are the redirections, applied in order, so that 2>&1 >file
+	// and >file 2>&1 differ as they should.
+	redirs []redirection
+}
+
+// parseCommand splits a simple command into its words and redirections,
+// removing quotes and expanding variables, command substitutions and globs
+// as it goes. Single quotes keep everything literal; double quotes still
+// expand; a backslash escapes the next character (inside double quotes
+// only $, `, " and \). Quoted or escaped glob characters match only
+// themselves. A glob in the command name must match no more than one
+// file. Unquoted expansions are split into words on $IFS, except in the
+// value of an assignment.
+func (s *Shell) parseCommand(cmdStr string, docs []*hereDoc) (*simpleCommand, error) {
+	cmd := &simpleCommand{}
 	var current strings.Builder
-	var inputFile, outputFile string
-	var appendMode bool
-	inQuote := false
-	quoteChar := rune(0)
-	i := 0
+	// pattern mirrors current with quoted glob characters escaped, and
+	// globbing records whether the word has an unquoted one.
+	var pattern strings.Builder
+	globbing := false
+	// started is set once the word has any content, even just "", so an
+	// empty quoted word is kept while an empty unquoted expansion is not.
+	started := false
+	// quoted records whether any of the word so far was quoted, and
+	// assigning whether it is a NAME=value assignment.
+	quoted, assigning := false, false
+	// substituted records whether an expansion added to the word
+	substituted := false
+	// array collects the words of a NAME=(...) assignment while inArray
+	var array arrayAssign
+	inArray := false
+	// startedAtQuote is started as it was before the last opening double
+	// quote, so that "${a[@]}" of an empty array makes no word at all.
+	startedAtQuote := false
+	// wordErr is the first error from finishing a word
+	var wordErr error
+	// redirect is the redirection operator waiting for its target word,
+	// and redirectFd the descriptor it applies to
+	redirect := ""
+	redirectFd := 0
+	inSingle, inDouble := false, false
 	runes := []rune(cmdStr)
+	s.substStatus = 0
 
-	for i < len(runes) {
-		r := runes[i]
+	ifs, ok := findVar("IFS")
+	if !ok {
+		ifs = " \t\n"
+	}
+
+	write := func(text string, isQuoted bool) {
+		for _, r := range text {
+			current.WriteRune(r)
+			if isQuoted && (isGlobMeta(r) || r == '\\') {
+				pattern.WriteRune('\\')
+			} else if isGlobMeta(r) {
+				globbing = true
+			}
+			pattern.WriteRune(r)
+		}
+		if isQuoted {
+			quoted = true
+		}
+		if isQuoted || text != "" {
+			started = true
+		}
+	}
+
+	finishWord := func() {
+		if !started {
+			return
+		}
+		word := current.String()
 
 		switch {
-		case r == '"' || r == '\'':
-			if inQuote {
-				if r == quoteChar {
-					inQuote = false
-					quoteChar = 0
-				} else {
-					current.WriteRune(r)
+		case redirect == "<<":
+			// The word is the delimiter; the body was read with the line
+			if len(docs) == 0 {
+				if wordErr == nil {
+					wordErr = errors.New("here-document body missing")
+				}
+				break
+			}
+			doc := docs[0]
+			docs = docs[1:]
+			body := doc.body
+			if !doc.quoted {
+				body = s.expandHereDoc(doc.body)
+			}
+			cmd.redirs = append(cmd.redirs, redirection{redirectFd, redirect, body})
+		case redirect != "":
+			if strings.HasSuffix(redirect, "&") && word != "-" && !isNumber(word) {
+				if wordErr == nil {
+					wordErr = fmt.Errorf("%s: ambiguous redirect", word)
+				}
+				break
+			}
+			cmd.redirs = append(cmd.redirs, redirection{redirectFd, redirect, word})
+		case assigning:
+			cmd.assigns = append(cmd.assigns, word)
+		default:
+			words := []string{word}
+			if globbing {
+				words = expandGlob(pattern.String())
+				if words == nil && options.failglob {
+					if wordErr == nil {
+						wordErr = fmt.Errorf("no match: %s", word)
+					}
+				} else if words == nil && !options.nullglob {
+					words = []string{word}
 				}
+
+				// Only one program can run, and a pattern that matches
+				// none is left to be reported as not found
+				if len(cmd.args) == 0 && !inArray {
+					if len(words) > 1 {
+						if wordErr == nil {
+							wordErr = fmt.Errorf("%s: ambiguous command: matches %s", word, strings.Join(words, " "))
+						}
+					} else if words == nil {
+						words = []string{word}
+					}
+				}
+			}
+			if inArray {
+				array.values = append(array.values, words...)
 			} else {
-				inQuote = true
-				quoteChar = r
+				if len(cmd.args) == 0 {
+					cmd.nameQuoted = quoted
+				}
+				cmd.args = append(cmd.args, words...)
+				for range words {
+					cmd.argQuoted = append(cmd.argQuoted, quoted)
+					cmd.argLiteral = append(cmd.argLiteral, !substituted && !globbing)
+				}
 			}
-			i++
-		case r == '<' && !inQuote:
-			if current.Len() > 0 {
-				args = append(args, os.ExpandEnv(current.String()))
-				current.Reset()
+		}
+
+		redirect = ""
+		current.Reset()
+		pattern.Reset()
+		globbing = false
+		started = false
+		quoted, assigning, substituted = false, false, false
+	}
+
+	// expanded adds the result of an expansion to the word, splitting it
+	// into further words unless it is quoted or assigned.
+	expanded := func(text string) {
+		if inDouble || assigning {
+			substituted = true
+			write(text, true)
+			return
+		}
+		for _, r := range text {
+			if strings.ContainsRune(ifs, r) {
+				finishWord()
+			} else {
+				substituted = true
+				write(string(r), false)
+			}
+		}
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case inSingle:
+			if r == '\'' {
+				inSingle = false
+			} else {
+				write(string(r), true)
 			}
+		case r == '\'' && !inDouble:
+			inSingle = true
+			started, quoted = true, true
+		case r == '"':
+			if !inDouble {
+				startedAtQuote = started
+				started = true
+			}
+			inDouble = !inDouble
+			quoted = true
+		case r == '\\' && i+1 < len(runes) && runes[i+1] == '\n':
+			// A backslash and newline join the lines, quoted or not
 			i++
-			for i < len(runes) && runes[i] == ' ' {
+		case r == '\\':
+			if i+1 < len(runes) && (!inDouble || strings.ContainsRune("$`\"\\", runes[i+1])) {
 				i++
+				r = runes[i]
 			}
-			for i < len(runes) && runes[i] != ' ' {
-				current.WriteRune(runes[i])
-				i++
+			write(string(r), true)
+		case r == '$':
+			// "$@" and "${a[@]}" are a word per element: the first and
+			// last join the text around them. Unquoted, each element is
+			// split further.
+			if words, n, ok := s.expandWords(runes[i+1:], inDouble); ok && (inDouble || !assigning) {
+				if inDouble && len(words) == 0 && current.Len() == 0 {
+					started = startedAtQuote
+				}
+				for j, word := range words {
+					if j > 0 {
+						finishWord()
+					}
+					if inDouble {
+						substituted = true
+						write(word, true)
+					} else {
+						expanded(word)
+					}
+				}
+				i += n
+				continue
 			}
-			inputFile = current.String()
-			current.Reset()
-		case r == '>' && !inQuote:
-			if current.Len() > 0 {
-				args = append(args, os.ExpandEnv(current.String()))
+			text, n := s.expandDollar(runes[i+1:])
+			if n == 0 {
+				write("$", inDouble)
+				continue
+			}
+			expanded(text)
+			i += n
+		case r == '`':
+			// `cmd` is the old form of $(cmd); inside it a backslash
+			// escapes only $, ` and \.
+			var inner strings.Builder
+			end := i + 1
+			for ; end < len(runes) && runes[end] != '`'; end++ {
+				if runes[end] == '\\' && end+1 < len(runes) && strings.ContainsRune("$`\\", runes[end+1]) {
+					end++
+				}
+				inner.WriteRune(runes[end])
+			}
+			if end == len(runes) {
+				return nil, errors.New("unexpected EOF while looking for matching ``'")
+			}
+			expanded(s.commandSubst(inner.String()))
+			i = end
+		case inDouble:
+			write(string(r), true)
+		case r == ' ' || r == '\t':
+			finishWord()
+		case r == '<' || r == '>':
+			// A word of digits right before the operator is the
+			// descriptor it redirects, as in 2>file
+			fd := 0
+			if r == '>' {
+				fd = 1
+			}
+			if redirect == "" && started && !quoted && !globbing && !assigning && isNumber(current.String()) {
+				fd, _ = strconv.Atoi(current.String())
 				current.Reset()
+				pattern.Reset()
+				started = false
 			}
-			i++
-			if i < len(runes) && runes[i] == '>' {
-				appendMode = true
-				i++
+			finishWord()
+			if redirect != "" {
+				return nil, fmt.Errorf("syntax error near unexpected token `%c'", r)
 			}
-			for i < len(runes) && runes[i] == ' ' {
+			redirectFd = fd
+			redirect = string(r)
+			if i+1 < len(runes) && (runes[i+1] == r || runes[i+1] == '&') {
+				redirect += string(runes[i+1])
 				i++
 			}
-			for i < len(runes) && runes[i] != ' ' {
-				current.WriteRune(runes[i])
+			if redirect == "<<" && i+1 < len(runes) && runes[i+1] == '-' {
 				i++
 			}
-			outputFile = current.String()
+		case r == '=' && !assigning && !inArray && redirect == "" && len(cmd.args) == 0 && isAssignable(current.String(), quoted):
+			assigning = true
+			write("=", false)
+		case r == '(' && assigning && !inArray && strings.HasSuffix(current.String(), "=") && isValidName(strings.TrimSuffix(current.String(), "=")):
+			array = arrayAssign{name: strings.TrimSuffix(current.String(), "=")}
+			inArray = true
 			current.Reset()
-		case r == ' ' && !inQuote:
-			if current.Len() > 0 {
-				args = append(args, os.ExpandEnv(current.String()))
-				current.Reset()
+			pattern.Reset()
+			started, quoted, assigning = false, false, false
+		case r == ')' && inArray:
+			finishWord()
+			cmd.arrays = append(cmd.arrays, array)
+			inArray = false
+		case r == '~' && (!started || assigning && strings.HasSuffix(current.String(), "=")):
+			// A tilde prefix at the start of a word, or of an assigned
+			// value, ends at a slash or the end of the word
+			end := i + 1
+			for end < len(runes) && isTildeRune(runes[end]) {
+				end++
 			}
-			i++
+			if end == len(runes) || strings.ContainsRune("/ \t;", runes[end]) || inArray && runes[end] == ')' {
+				if dir, ok := expandTilde(string(runes[i+1 : end])); ok {
+					write(dir, true)
+					i = end - 1
+					continue
+				}
+			}
+			write("~", false)
 		default:
-			current.WriteRune(r)
-			i++
+			write(string(r), false)
 		}
 	}
 
-	if current.Len() > 0 {
-		args = append(args, os.ExpandEnv(current.String()))
+	finishWord()
+
+	if inSingle || inDouble {
+		quote := '\''
+		if inDouble {
+			quote = '"'
+		}
+		return nil, &statusError{status: 2, err: fmt.Errorf("unexpected EOF while looking for matching `%c'", quote)}
+	}
+	if redirect != "" {
+		return nil, errors.New("syntax error near unexpected token `newline'")
+	}
+	if inArray {
+		return nil, errors.New("syntax error: unexpected end of input")
+	}
+	if wordErr != nil {
+		return nil, wordErr
 	}
 
-	return args, inputFile, outputFile, appendMode, nil
+	debugf("parsed %q: %s", cmdStr, cmd)
+	return cmd, nil
 }
 
-func execPipeline(commands []string, background bool) error {
-	var cmds []*exec.Cmd
+// pipelineStage is one command of a pipeline: either an external process
+// or a builtin run in a subshell process against the pipe ends.
+type pipelineStage struct {
+	args    []string
+	redirs  []redirection
+	cmd     *exec.Cmd
+	builtin bool
+	fds     fdTable
+	// owned are the pipe ends and redirection files opened for the
+	// stage, which the shell closes once it is running.
+	owned []*os.File
+}
 
-	for i, cmdStr := range commands {
-		args, inputFile, outputFile, appendMode, err := parseCommand(cmdStr)
-		if err != nil {
-			return err
+func (s *Shell) execPipeline(commands []string, docs [][]*hereDoc, background bool) error {
+	var stages []*pipelineStage
+	// rendered is each command as the jobs table shows it
+	var rendered []string
+	// Files the shell opened for the stages. Once every stage has started
+	// each is closed by the stage that uses it; before that, by us.
+	var opened []*os.File
+	started := false
+	defer func() {
+		if started {
+			return
 		}
-
-		if len(args) == 0 {
-			continue
+		for _, file := range opened {
+			file.Close()
 		}
+	}()
 
-		path, err := exec.LookPath(args[0])
+	for i, cmdStr := range commands {
+		cmd, err := s.parseCommand(cmdStr, docs[i])
 		if err != nil {
-			return fmt.Errorf("%s: command not found", args[0])
+			return err
 		}
+		rendered = append(rendered, cmd.String())
 
-		cmd := exec.Command(path, args[1:]...)
-
-		// Handle input redirection for first command
-		if i == 0 && inputFile != "" {
-			file, err := os.Open(inputFile)
-			if err != nil {
-				return err
+		// Each stage runs apart from the shell, so assignments without a
+		// command have no effect
+		args := cmd.args
+		if len(args) == 0 {
+			continue
+		}
+		if s.expandsAlias(cmd) {
+			args = s.aliasWords(cmd)
+			if len(args) == 0 {
+				continue
 			}
-			cmd.Stdin = file
 		}
 
-		// Handle output redirection for last command
-		if i == len(commands)-1 && outputFile != "" {
-			var file *os.File
-			var err error
-			if appendMode {
-				file, err = os.OpenFile(outputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			} else {
-				file, err = os.Create(outputFile)
-			}
+		stage := &pipelineStage{args: args, redirs: cmd.redirs}
+		if _, ok := builtins[args[0]]; ok {
+			debugf("pipeline stage %d: builtin %q", i, args)
+			stage.builtin = true
+		} else {
+			path, err := exec.LookPath(args[0])
 			if err != nil {
-				return err
+				return notFoundError(args[0])
 			}
-			defer file.Close()
-			cmd.Stdout = file
+			debugf("pipeline stage %d: external %s %q", i, path, args)
+			stage.cmd = exec.Command(path, args[1:]...)
+			stage.cmd.Env = append(os.Environ(), append(cmd.assigns, "_="+path)...)
 		}
 
-		cmd.Stderr = os.Stderr
-		cmds = append(cmds, cmd)
+		stages = append(stages, stage)
+	}
+
+	if len(stages) == 0 {
+		return nil
 	}
 
-	// Connect pipes
-	for i := 0; i < len(cmds)-1; i++ {
-		pipe, err := cmds[i].StdoutPipe()
+	// Connect pipes; the ends of the pipeline keep the shell's streams
+	for _, stage := range stages {
+		stage.fds = s.fds()
+	}
+	for i := 0; i < len(stages)-1; i++ {
+		r, w, err := os.Pipe()
 		if err != nil {
 			return err
 		}
-		cmds[i+1].Stdin = pipe
+		opened = append(opened, r, w)
+		stages[i].fds.stdout = w
+		stages[i].owned = append(stages[i].owned, w)
+		stages[i+1].fds.stdin = r
+		stages[i+1].owned = append(stages[i+1].owned, r)
 	}
 
-	// Set stdout for last command if not redirected
-	if cmds[len(cmds)-1].Stdout == nil {
-		cmds[len(cmds)-1].Stdout = os.Stdout
+	// Each stage's redirections apply on top of its pipes
+	for _, stage := range stages {
+		table, files, err := stage.fds.apply(stage.redirs)
+		if err != nil {
+			return err
+		}
+		opened = append(opened, files...)
+		stage.fds = table
+		stage.owned = append(stage.owned, files...)
 	}
 
-	// Set stdin for first command if not redirected
-	if cmds[0].Stdin == nil {
-		cmds[0].Stdin = os.Stdin
+	// Start all commands. The processes share a process group, led by the
+	// first, so the pipeline can be signalled as a unit. In the foreground
+	// that needs job control, and the group has the terminal until the
+	// pipeline finishes.
+	var cmds []*exec.Cmd
+	pgid := 0
+	if !background && ttyFd >= 0 {
+		defer setForeground(shellPgid)
 	}
-
-	// Start all commands
-	for _, cmd := range cmds {
-		if err := cmd.Start(); err != nil {
+	for _, stage := range stages {
+		if stage.builtin {
+			// A builtin runs in a subshell, as bash forks one, so what it
+			// changes is not the shell's
+			cmd, state, err := s.newSubshell(stage.fds, stage.args, "")
+			if err != nil {
+				return err
+			}
+			opened = append(opened, state)
+			stage.owned = append(stage.owned, state)
+			stage.cmd = cmd
+		} else {
+			stage.fds.setup(stage.cmd)
+		}
+		if background {
+			stage.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: pgid}
+		} else {
+			stage.cmd.SysProcAttr = foregroundAttr(pgid)
+		}
+		if err := stage.cmd.Start(); err != nil {
 			return err
 		}
+		cmds = append(cmds, stage.cmd)
+		if pgid == 0 && stage.cmd.SysProcAttr != nil {
+			pgid = stage.cmd.Process.Pid
+		}
 	}
 
-	if background {
-		jobsMutex.Lock()
-		job := &Job{
-			ID:      jobCounter,
-			PID:     cmds[len(cmds)-1].Process.Pid,
-			Command: strings.Join(commands, " | "),
-		}
-		jobs[jobCounter] = job
-		fmt.Printf("[%d] %d\n", job.ID, job.PID)
-		jobCounter++
-		jobsMutex.Unlock()
+	started = true
 
-		go func() {
-			for _, cmd := range cmds {
-				cmd.Wait()
-			}
-		}()
+	// The children hold their own copies of the stages' pipe ends and
+	// files; drop the shell's so EOF propagates.
+	for _, stage := range stages {
+		closeFiles(stage.owned)
+	}
+
+	// A pipeline's status is that of its last command, so it finishes
+	// once its processes have been reaped
+	job := newJob(cmds, pgid, strings.Join(rendered, " | "))
+	startReaping(job, true)
+
+	if background {
+		s.startBackground(job)
 		return nil
 	}
+	return s.waitForeground(job)
+}
 
-	// Wait for all commands
-	for _, cmd := range cmds {
-		if err := cmd.Wait(); err != nil {
-			return err
-		}
+// execExternal runs args as an external program with the redirections of
+// redir.
+func (s *Shell) execExternal(args []string, redir *simpleCommand, background bool) error {
+	if !background && ttyFd >= 0 {
+		defer setForeground(shellPgid)
+	}
+	job, err := s.startExternal(args, redir, background)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	if background {
+		s.startBackground(job)
+		return nil
+	}
+	return s.waitForeground(job)
 }
 
-func execExternal(args []string, inputFile, outputFile string, appendMode, background bool) error {
+// startExternal starts args as an external program with the redirections
+// of redir, returning its job for the caller to wait for or put in the
+// background. A foreground job under job control is given the terminal,
+// which the caller takes back once it is done.
+func (s *Shell) startExternal(args []string, redir *simpleCommand, background bool) (*Job, error) {
 	path, err := exec.LookPath(args[0])
 	if err != nil {
-		return fmt.Errorf("%s: command not found", args[0])
+		return nil, notFoundError(args[0])
 	}
 
+	debugf("external %s %q background=%t", path, args, background)
 	cmd := exec.Command(path, args[1:]...)
+	// A program sees the path it was run as in $_
+	cmd.Env = append(os.Environ(), "_="+path)
 
-	// Handle input redirection
-	if inputFile != "" {
-		file, err := os.Open(inputFile)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		cmd.Stdin = file
-	} else {
-		cmd.Stdin = os.Stdin
+	table, files, err := s.fds().apply(redir.redirs)
+	if err != nil {
+		return nil, err
 	}
+	defer closeFiles(files)
+	table.setup(cmd)
 
-	// Handle output redirection
-	if outputFile != "" {
-		var file *os.File
-		if appendMode {
-			file, err = os.OpenFile(outputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		} else {
-			file, err = os.Create(outputFile)
-		}
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		cmd.Stdout = file
+	// In the background, and in the foreground under job control, the
+	// command runs in its own process group. A foreground group has the
+	// terminal until it finishes or stops.
+	if background {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	} else {
-		cmd.Stdout = os.Stdout
+		cmd.SysProcAttr = foregroundAttr(0)
 	}
-
-	cmd.Stderr = os.Stderr
-
-	if background {
-		if err := cmd.Start(); err != nil {
-			return err
-		}
-
-		jobsMutex.Lock()
-		job := &Job{
-			ID:      jobCounter,
-			PID:     cmd.Process.Pid,
-			Command: strings.Join(args, " "),
-		}
-		jobs[jobCounter] = job
-		fmt.Printf("[%d] %d\n", job.ID, job.PID)
-		jobCounter++
-		jobsMutex.Unlock()
-
-		go cmd.Wait()
-		return nil
+	if err := cmd.Start(); err != nil {
+		return nil, err
 	}
 
-	return cmd.Run()
+	pgid := 0
+	if cmd.SysProcAttr != nil {
+		pgid = cmd.Process.Pid
+	}
+	rendered := *redir
+	rendered.args = args
+	job := newJob([]*exec.Cmd{cmd}, pgid, rendered.String())
+	startReaping(job, true)
+	return job, nil
 }
 
-func handleCD(args []string) error {
+// handleCD changes directory, to $CDHOME or else $HOME if no directory is
+// given, or with shopt cdfile to the directory of a file that is given. By
+// default, or with -L, it follows the path logically, so .. after a
+// symlink goes back to where the link was, and sets $PWD to that path;
+// with -P it resolves symlinks first.
+func (s *Shell) handleCD(args []string) error {
 	var dir string
 
+	physical := false
+	for len(args) > 1 && (args[1] == "-L" || args[1] == "-P") {
+		physical = args[1] == "-P"
+		args = append(args[:1:1], args[2:]...)
+	}
+	if len(args) > 2 {
+		return usageError("cd", "too many arguments")
+	}
+
 	if len(args) < 2 {
-		home, err := os.UserHomeDir()
-		if err != nil {
-			return fmt.Errorf("could not find home directory: %w", err)
+		// $CDHOME, if set, is where cd goes without an argument
+		dir = lookupVar("CDHOME")
+		if dir == "" {
+			dir = lookupVar("HOME")
+		}
+		if dir == "" {
+			return errors.New("cd: HOME not set")
 		}
-		dir = home
 	} else if args[1] == "-" {
 		dir = os.Getenv("OLDPWD")
 		if dir == "" {
 			return errors.New("cd: OLDPWD not set")
 		}
-		fmt.Println(dir)
 	} else {
 		dir = args[1]
+	}
 
-		if strings.HasPrefix(dir, "~") {
-			home, err := os.UserHomeDir()
-			if err != nil {
-				return fmt.Errorf("could not find home directory: %w", err)
-			}
-			dir = filepath.Join(home, dir[1:])
+	// Check the target before going anywhere, for a clearer error than
+	// chdir gives and so that a failed cd changes nothing. It is found
+	// from $PWD, which is only checked once the target is known to be
+	// there.
+	pwd := os.Getenv("PWD")
+	target, err := s.findCDTarget(pwd, dir, physical)
+	if err != nil {
+		return err
+	}
+	oldPwd, _ := logicalDir()
+	if oldPwd != pwd {
+		// $PWD is out of date, so the target is found again from where
+		// the shell really is
+		if target, err = s.findCDTarget(oldPwd, dir, physical); err != nil {
+			return err
 		}
 	}
 
-	oldPwd, _ := os.Getwd()
-	if err := os.Chdir(dir); err != nil {
+	newPwd, err := changeDir(target)
+	if err != nil {
 		return fmt.Errorf("cd: %w", err)
 	}
+	if len(args) > 1 && args[1] == "-" {
+		fmt.Fprintln(s.Stdout, newPwd)
+	}
 	os.Setenv("OLDPWD", oldPwd)
+	os.Setenv("PWD", newPwd)
+
+	return nil
+}
+
+// cdError reports that cd could not go to dir, giving only the reason
+// from a path error.
+func cdError(dir string, err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return fmt.Errorf("cd: %s: %w", dir, err)
+}
+
+// cdTarget is the directory cd goes to: its path, whether that is the
+// logical path as written rather than the physical one, and what a stat
+// of it found.
+type cdTarget struct {
+	path    string
+	logical bool
+	info    fs.FileInfo
+}
+
+// findCDTarget finds where cd dir goes from the logical directory from,
+// checking that it is a directory, or with cdfile a file, and with cdspell
+// correcting the name of one that does not exist.
+func (s *Shell) findCDTarget(from, dir string, physical bool) (cdTarget, error) {
+	target, err := statTarget(from, dir, physical)
+	switch {
+	case err == nil && target.info.IsDir():
+	case err == nil && options.cdFile && target.info.Mode().IsRegular():
+		// With cdfile, a file stands for the directory it is in
+		target.path = filepath.Dir(target.path)
+	case err == nil:
+		return target, cdError(dir, syscall.ENOTDIR)
+	case options.cdspell && errors.Is(err, fs.ErrNotExist):
+		corrected, ok := spellCorrectDir(dir)
+		if !ok {
+			return target, cdError(dir, err)
+		}
+		fmt.Fprintln(s.Stdout, corrected)
+		if target, err = statTarget(from, corrected, physical); err != nil {
+			return target, cdError(corrected, err)
+		}
+	default:
+		return target, cdError(dir, err)
+	}
+	return target, nil
+}
+
+// statTarget looks up the directory cd dir goes to from the logical
+// directory from: the logical path, unless physical is set or that does
+// not exist, or else dir itself. The two only differ for a path with ..,
+// so for any other it is looked up once.
+func statTarget(from, dir string, physical bool) (cdTarget, error) {
+	if !physical {
+		target := cdTarget{path: logicalPath(from, dir), logical: true}
+		var err error
+		target.info, err = os.Stat(target.path)
+		if err == nil || !strings.Contains(dir, "..") {
+			return target, err
+		}
+	}
+	target := cdTarget{path: dir}
+	var err error
+	target.info, err = os.Stat(dir)
+	return target, err
+}
+
+// logicalPath is dir taken relative to the logical directory from, with
+// .. removing the name before it rather than following a symlink back.
+func logicalPath(from, dir string) string {
+	if !filepath.IsAbs(dir) && from != "" {
+		dir = filepath.Join(from, dir)
+	}
+	return filepath.Clean(dir)
+}
+
+// changeDir changes to target and returns the new logical directory: the
+// path as written, with .. taken to mean the parent of what comes before
+// it, or for a physical target the path with symlinks resolved.
+func changeDir(target cdTarget) (string, error) {
+	if err := os.Chdir(target.path); err != nil {
+		return "", err
+	}
+	if target.logical {
+		return target.path, nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(wd)
+}
+
+// logicalDir returns the current directory as the user reached it, through
+// any symlinks: $PWD if it still names the current directory, otherwise
+// the path from the kernel.
+func logicalDir() (string, error) {
+	if pwd := os.Getenv("PWD"); filepath.IsAbs(pwd) {
+		a, errA := os.Stat(pwd)
+		b, errB := os.Stat(".")
+		if errA == nil && errB == nil && os.SameFile(a, b) {
+			return pwd, nil
+		}
+	}
+	return os.Getwd()
+}
+
+// handleExit exits with the given status, or with the status of the last
+// command when there is none. An interactive shell with jobs still running
+// or stopped lists them instead, and only exits if exit is run again
+// straight away, or given -f.
+func (s *Shell) handleExit(args []string) error {
+	force := len(args) > 1 && args[1] == "-f"
+	if force {
+		args = append(args[:1:1], args[2:]...)
+	}
+	if len(args) > 2 {
+		return usageError("exit", "too many arguments")
+	}
+
+	status := s.lastStatus
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return usageError("exit", args[1]+": numeric argument required")
+		}
+		status = n & 0xff
+	}
+
+	if s.interactive && !s.subshell && !force && !s.exitWarned && s.warnJobs() {
+		s.exitWarned = true
+		return silentStatus(1)
+	}
+	s.exit(status)
+	return nil
+}
+
+// handlePwd prints the current directory: the logical path through any
+// symlinks by default or with -L, the physical path with -P.
+func (s *Shell) handlePwd(args []string) error {
+	physical := false
+	for _, arg := range args[1:] {
+		switch arg {
+		case "-L":
+			physical = false
+		case "-P":
+			physical = true
+		default:
+			return invalidOption("pwd", arg)
+		}
+	}
 
+	cwd, err := logicalDir()
+	if err == nil && physical {
+		cwd, err = filepath.EvalSymlinks(cwd)
+	}
+	if err != nil {
+		return fmt.Errorf("pwd: %w", err)
+	}
+	fmt.Fprintln(s.Stdout, cwd)
 	return nil
 }
 
-func handleExport(args []string) error {
+// handleExport puts variables in the environment of later commands, or
+// with -n takes them out of it again.
+func (s *Shell) handleExport(args []string) error {
+	unexport := false
+	if len(args) > 1 && args[1] == "-n" {
+		unexport = true
+		args = append(args[:1:1], args[2:]...)
+	}
 	if len(args) < 2 {
-		return errors.New("export: usage: export VAR=value")
+		return usageError("export", "")
 	}
 
+	// Values arrive already expanded, exactly once, by parseCommand, so
+	// export A=$A:x appends to the current value and export A='$A' keeps
+	// it literal.
 	for _, arg := range args[1:] {
-		parts := strings.SplitN(arg, "=", 2)
-		if len(parts) != 2 {
-			return fmt.Errorf("export: invalid format: %s", arg)
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !isValidName(name) {
+			return fmt.Errorf("export: `%s': not a valid identifier", arg)
+		}
+		if unexport {
+			// -n takes a variable out of the environment of commands,
+			// keeping it as a shell variable
+			if !hasValue {
+				if value, hasValue = os.LookupEnv(name); !hasValue {
+					if _, ok := findVar(name); !ok {
+						return fmt.Errorf("export: %s: not set", name)
+					}
+					continue
+				}
+			}
+			os.Unsetenv(name)
+			shellVars[name] = value
+			continue
+		}
+		if !hasValue {
+			// Exporting a shell variable moves it into the environment
+			value, hasValue = shellVars[name]
+		}
+		if hasValue {
+			os.Setenv(name, value)
+			delete(shellVars, name)
 		}
-		os.Setenv(parts[0], parts[1])
 	}
 
 	return nil
 }
 
-func handleHistory(args []string) error {
+func (s *Shell) handleHistory(args []string) error {
+	asJSON := len(args) > 1 && args[1] == "--json"
+	if asJSON {
+		args = append(args[:1:1], args[2:]...)
+	}
+
 	count := len(history)
 	if len(args) > 1 {
 		n, err := strconv.Atoi(args[1])
 		if err != nil {
-			return fmt.Errorf("history: invalid number: %s", args[1])
+			return usageError("history", args[1]+": numeric argument required")
 		}
 		if n < count {
 			count = n
@@ -526,17 +1922,25 @@ func handleHistory(args []string) error {
 		start = 0
 	}
 
+	if asJSON {
+		entries := []historyJSON{}
+		for i := start; i < len(history); i++ {
+			entries = append(entries, historyJSON{Number: i + 1, Command: history[i]})
+		}
+		return writeJSON(s.Stdout, entries)
+	}
+
 	for i := start; i < len(history); i++ {
-		fmt.Printf("%4d  %s\n", i+1, history[i])
+		fmt.Fprintf(s.Stdout, "%4d  %s\n", i+1, history[i])
 	}
 
 	return nil
 }
 
-func handleAlias(args []string) error {
+func (s *Shell) handleAlias(args []string) error {
 	if len(args) == 1 {
 		for name, value := range aliases {
-			fmt.Printf("alias %s='%s'\n", name, value)
+			fmt.Fprintf(s.Stdout, "alias %s='%s'\n", name, value)
 		}
 		return nil
 	}
@@ -552,9 +1956,9 @@ func handleAlias(args []string) error {
 	return nil
 }
 
-func handleUnalias(args []string) error {
+func (s *Shell) handleUnalias(args []string) error {
 	if len(args) < 2 {
-		return errors.New("unalias: usage: unalias name")
+		return usageError("unalias", "")
 	}
 
 	for _, name := range args[1:] {
@@ -564,123 +1968,344 @@ func handleUnalias(args []string) error {
 	return nil
 }
 
-func handleJobs() error {
-	jobsMutex.Lock()
-	defer jobsMutex.Unlock()
+func (s *Shell) handleSource(args []string) error {
+	if len(args) < 2 {
+		return usageError(args[0], "")
+	}
 
-	for id, job := range jobs {
-		status := "Running"
-		if job.Stopped {
-			status = "Stopped"
-		}
-		fmt.Printf("[%d]  %s\t%s\n", id, status, job.Command)
+	path, err := findSourceFile(args[1])
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[0], err)
 	}
 
+	// Arguments after the file name are its positional parameters while
+	// it runs
+	if len(args) > 2 {
+		saved := s.params
+		s.params = args[2:]
+		defer func() { s.params = saved }()
+	}
+
+	if err := s.execFile(path); err != nil {
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+
+	// The file's status is that of the last line it ran, so that a file
+	// stopped by errexit stops the one sourcing it too
+	if s.lastStatus != 0 {
+		return silentStatus(s.lastStatus)
+	}
 	return nil
 }
 
-func handleFg(args []string) error {
-	jobsMutex.Lock()
-	defer jobsMutex.Unlock()
+// findSourceFile resolves the file named by source. A name containing a
+// slash is used as is; otherwise the directories in GOSH_LIB_PATH (or PATH
+// when that is unset) are searched, and then the current directory.
+func findSourceFile(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
 
-	if len(jobs) == 0 {
-		return errors.New("fg: no jobs")
+	searchPath, ok := os.LookupEnv("GOSH_LIB_PATH")
+	if !ok {
+		searchPath = os.Getenv("PATH")
 	}
+	dirs := append(filepath.SplitList(searchPath), ".")
 
-	var jobID int
-	if len(args) > 1 {
-		id, err := strconv.Atoi(strings.TrimPrefix(args[1], "%"))
+	for _, dir := range dirs {
+		if dir == "" {
+			dir = "."
+		}
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path, nil
+		}
+	}
+
+	return "", fmt.Errorf("%s: file not found (searched %s)", name, strings.Join(dirs, ", "))
+}
+
+// handleTee copies stdin to stdout and to each named file. A file that
+// cannot be opened or written is reported and dropped while the others
+// keep receiving output.
+func (s *Shell) handleTee(args []string) error {
+	files := args[1:]
+	appendMode := false
+	if len(files) > 0 && files[0] == "-a" {
+		appendMode = true
+		files = files[1:]
+	}
+
+	failed := false
+	names := []string{"stdout"}
+	writers := []io.Writer{s.Stdout}
+	for _, name := range files {
+		file, err := openOutputFile(name, appendMode)
 		if err != nil {
-			return fmt.Errorf("fg: invalid job id: %s", args[1])
+			fmt.Fprintf(s.Stderr, "tee: %v\n", err)
+			failed = true
+			continue
 		}
-		jobID = id
-	} else {
-		// Get most recent job
-		maxID := 0
-		for id := range jobs {
-			if id > maxID {
-				maxID = id
+		defer file.Close()
+		names = append(names, name)
+		writers = append(writers, file)
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := s.Stdin.Read(buf)
+		if n > 0 {
+			for i := 0; i < len(writers); i++ {
+				if _, err := writers[i].Write(buf[:n]); err != nil {
+					// Like a process killed by SIGPIPE, stop once the
+					// reader downstream has gone away.
+					if errors.Is(err, syscall.EPIPE) {
+						return &statusError{status: 128 + int(syscall.SIGPIPE), err: fmt.Errorf("tee: %w", err)}
+					}
+					fmt.Fprintf(s.Stderr, "tee: %s: %v\n", names[i], err)
+					failed = true
+					names = append(names[:i], names[i+1:]...)
+					writers = append(writers[:i], writers[i+1:]...)
+					i--
+				}
 			}
 		}
-		jobID = maxID
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("tee: %w", readErr)
+		}
 	}
 
-	job, ok := jobs[jobID]
-	if !ok {
-		return fmt.Errorf("fg: job %d not found", jobID)
+	if failed {
+		return silentStatus(1)
 	}
+	return nil
+}
 
-	fmt.Printf("%s\n", job.Command)
-	// Note: Full job control requires more complex signal handling
-	delete(jobs, jobID)
+// handleConfirm asks on the terminal before running its arguments as a
+// command, so that e.g. alias rm='confirm rm' guards destructive commands.
+func (s *Shell) handleConfirm(args []string) error {
+	if len(args) < 2 {
+		return usageError("confirm", "")
+	}
 
-	return nil
+	answer, err := readTerminalLine(fmt.Sprintf("Run '%s'? [y/N] ", strings.Join(args[1:], " ")))
+	if err != nil {
+		return fmt.Errorf("confirm: %w", err)
+	}
+	if answer = strings.ToLower(answer); answer != "y" && answer != "yes" {
+		return silentStatus(1)
+	}
+
+	if handler, ok := builtins[args[1]]; ok {
+		return handler(s, args[1:])
+	}
+	return s.execExternal(args[1:], &simpleCommand{}, false)
 }
 
-func handleBg(args []string) error {
-	return errors.New("bg: not fully implemented")
+// readTerminalLine prompts on the controlling terminal and reads the reply
+// from it, so answers come from the user even when stdin is redirected.
+func readTerminalLine(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
 }
 
-func writeToFile(content, filename string, appendMode bool) error {
-	var file *os.File
-	var err error
+func (s *Shell) handleUmask(args []string) error {
+	if len(args) < 2 {
+		// The only way to read the umask is to set it, so put it back
+		mask := syscall.Umask(0)
+		syscall.Umask(mask)
+		fmt.Fprintf(s.Stdout, "%04o\n", mask)
+		return nil
+	}
+
+	mask, err := strconv.ParseUint(args[1], 8, 32)
+	if err != nil || mask > 0777 {
+		return usageError("umask", args[1]+": invalid octal number")
+	}
+	syscall.Umask(int(mask))
+
+	return nil
+}
 
+// openOutputFile opens filename as the target of an output redirection,
+// truncating it unless appendMode is set. New files are created 0666 less
+// the umask.
+func openOutputFile(filename string, appendMode bool) (*os.File, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
 	if appendMode {
-		file, err = os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	} else {
-		file, err = os.Create(filename)
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
 	}
+	return os.OpenFile(filename, flags, 0666)
+}
 
+// historyFile returns where the history is kept: $HISTFILE if it is set,
+// otherwise ~/.gosh_history. ok is false if HISTFILE is set but empty,
+// which keeps the history to the session.
+func historyFile() (name string, ok bool) {
+	if name, set := findVar("HISTFILE"); set {
+		return name, name != ""
+	}
+	home, err := os.UserHomeDir()
 	if err != nil {
-		return err
+		return "", false
 	}
-	defer file.Close()
+	return filepath.Join(home, ".gosh_history"), true
+}
 
-	_, err = file.WriteString(content + "\n")
-	return err
+// historySaveFailed is set once a failure to save the history has been
+// reported, so that it is not reported again.
+var historySaveFailed bool
+
+// historySaved is how much of history is already in the history file:
+// what was loaded from it, and what histappend has added since.
+var historySaved int
+
+// defaultHistFileSize is how many lines the history file keeps when
+// HISTFILESIZE is unset or not a number.
+const defaultHistFileSize = 1000
+
+// histFileSize returns the most lines the history file may keep.
+func histFileSize() int {
+	n, err := strconv.Atoi(lookupVar("HISTFILESIZE"))
+	if err != nil || n < 0 {
+		return defaultHistFileSize
+	}
+	return n
 }
 
 func loadHistory() {
-	home, err := os.UserHomeDir()
+	histFile, ok := historyFile()
+	if !ok {
+		return
+	}
+
+	entries, err := readHistory(histFile)
 	if err != nil {
 		return
 	}
+	history = append(history, entries...)
+	historySaved = len(history)
+}
 
-	histFile := filepath.Join(home, ".gosh_history")
+// readHistory reads the entries of a history file. An entry typed over
+// several lines, inside quotes, is saved as those lines, and is joined
+// back up in the same way as it was read.
+func readHistory(histFile string) ([]string, error) {
 	file, err := os.Open(histFile)
 	if err != nil {
-		return
+		return nil, err
 	}
 	defer file.Close()
 
+	var entries []string
+	entry, open := "", false
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		history = append(history, scanner.Text())
+		if open {
+			entry += "\n" + scanner.Text()
+		} else {
+			entry = scanner.Text()
+		}
+		if open = openQuote(entry) != 0; !open {
+			entries = append(entries, entry)
+		}
 	}
+	if open {
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
 }
 
+// saveHistory writes the history file, keeping its last $HISTFILESIZE
+// entries. With histappend only the commands of this session are added to
+// it, so that shells running side by side do not lose each other's.
 func saveHistory() {
-	home, err := os.UserHomeDir()
-	if err != nil {
+	histFile, ok := historyFile()
+	if !ok {
 		return
 	}
 
-	histFile := filepath.Join(home, ".gosh_history")
+	var err error
+	if options.histAppend {
+		err = appendHistory(histFile)
+	} else {
+		err = writeHistory(histFile, history)
+	}
+	if err != nil && !historySaveFailed {
+		fmt.Fprintf(os.Stderr, "Error saving history: %v\n", err)
+		historySaveFailed = true
+	}
+}
+
+// writeHistory replaces the history file with the last $HISTFILESIZE of
+// entries.
+func writeHistory(histFile string, entries []string) error {
 	file, err := os.Create(histFile)
 	if err != nil {
-		return
+		return err
 	}
 	defer file.Close()
+	return writeEntries(file, entries)
+}
 
-	// Save last 1000 commands
-	start := 0
-	if len(history) > 1000 {
-		start = len(history) - 1000
+// writeEntries writes the last $HISTFILESIZE of entries to w.
+func writeEntries(w io.Writer, entries []string) error {
+	start := max(len(entries)-histFileSize(), 0)
+	bw := bufio.NewWriter(w)
+	for _, entry := range entries[start:] {
+		bw.WriteString(entry + "\n")
 	}
+	return bw.Flush()
+}
 
-	for i := start; i < len(history); i++ {
-		file.WriteString(history[i] + "\n")
+// appendHistory adds the commands not yet saved to the end of the history
+// file, then trims it to $HISTFILESIZE entries if it has grown past that.
+// The file is locked throughout, so that another shell appending to it
+// cannot do so between it being read and rewritten, and is rewritten in
+// place, so that one waiting for the lock then appends to what is left.
+func appendHistory(histFile string) error {
+	file, err := os.OpenFile(histFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	for _, line := range history[min(historySaved, len(history)):] {
+		w.WriteString(line + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	historySaved = len(history)
+
+	entries, err := readHistory(histFile)
+	if err != nil {
+		return err
+	}
+	if len(entries) <= histFileSize() {
+		return nil
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
 	}
+	return writeEntries(file, entries)
 }
 
 func loadAliases() {
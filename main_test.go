@@ -0,0 +1,481 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestMain lets the test binary, as os.Executable, run the subshells the
+// tests start.
+func TestMain(m *testing.M) {
+	if fd := os.Getenv(subshellEnv); fd != "" {
+		runSubshell(fd)
+	}
+	os.Exit(m.Run())
+}
+
+// run runs each line in s, failing the test if one reports an error, and
+// returns the output of the last.
+func run(t *testing.T, s *Shell, lines ...string) (string, int) {
+	t.Helper()
+	var out string
+	var status int
+	for _, line := range lines {
+		stdout, stderr, st, err := s.Run(line)
+		if err != nil {
+			t.Fatalf("%q: %v (stderr %q)", line, err, stderr)
+		}
+		out, status = stdout, st
+	}
+	return out, status
+}
+
+func TestPositionalWords(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`printf '<%s>' "$@"`, "<a b><c><>"},
+		{`printf '<%s>' $@`, "<a><b><c>"},
+		{`printf '<%s>' "$*"`, "<a b c >"},
+		{`printf '<%s>' x"$@"y`, "<xa b><c><y>"},
+		{`printf '<%s>' "${@}"`, "<a b><c><>"},
+		{`echo $#`, "3\n"},
+	}
+
+	s := NewShell()
+	run(t, s, `set -- "a b" c ""`)
+	for _, tt := range tests {
+		if got, _ := run(t, s, tt.line); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestNoPositionalWords(t *testing.T) {
+	s := NewShell()
+	run(t, s, "set --")
+	if got, _ := run(t, s, `printf '<%s>' x "$@" y`); got != "<x><y>" {
+		t.Errorf(`"$@" with no parameters: got %q, want no word`, got)
+	}
+}
+
+func TestPositionalJoinIFS(t *testing.T) {
+	s := NewShell()
+	t.Cleanup(func() { delete(shellVars, "IFS") })
+	run(t, s, `set -- "a b" c ""`, "IFS=,")
+	if got, _ := run(t, s, `printf '<%s>' "$*"`); got != "<a b,c,>" {
+		t.Errorf(`"$*" with IFS=,: got %q, want "<a b,c,>"`, got)
+	}
+}
+
+func TestSignalByName(t *testing.T) {
+	tests := []struct {
+		spec string
+		want syscall.Signal
+		ok   bool
+	}{
+		{"INT", syscall.SIGINT, true},
+		{"SIGINT", syscall.SIGINT, true},
+		{"int", syscall.SIGINT, true},
+		{"2", syscall.SIGINT, true},
+		{"TERM", syscall.SIGTERM, true},
+		{"sigkill", syscall.SIGKILL, true},
+		{"TSTP", syscall.SIGTSTP, true},
+		{"CONT", syscall.SIGCONT, true},
+		{"0", 0, true},
+		{"NOPE", 0, false},
+		{"SIG", 0, false},
+		{"-1", 0, false},
+		{"65", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := signalByName(tt.spec)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("signalByName(%q) = %d, %t; want %d, %t", tt.spec, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNameBySignal(t *testing.T) {
+	for _, s := range signals {
+		if got := nameBySignal(s.sig); got != s.name {
+			t.Errorf("nameBySignal(%d) = %q, want %q", s.sig, got, s.name)
+		}
+		if sig, ok := signalByName(s.name); !ok || sig != s.sig {
+			t.Errorf("signalByName(%q) = %d, %t; want %d", s.name, sig, ok, s.sig)
+		}
+	}
+	if got := nameBySignal(syscall.Signal(99)); got != "" {
+		t.Errorf("nameBySignal(99) = %q, want none", got)
+	}
+}
+
+func TestKillList(t *testing.T) {
+	tests := []struct {
+		line   string
+		want   string
+		status int
+	}{
+		{"kill -l 2", "INT\n", 0},
+		{"kill -l 15 9", "TERM\nKILL\n", 0},
+		{"kill -l 143", "TERM\n", 0},
+		{"kill -l TERM", "15\n", 0},
+		{"kill -l SIGHUP", "1\n", 0},
+		{"kill -l NOPE", "", 1},
+	}
+
+	s := NewShell()
+	for _, tt := range tests {
+		got, status := run(t, s, tt.line)
+		if got != tt.want || status != tt.status {
+			t.Errorf("%s: got %q, status %d; want %q, status %d", tt.line, got, status, tt.want, tt.status)
+		}
+	}
+
+	list, _ := run(t, s, "kill -l")
+	for _, name := range []string{"1) SIGHUP", "2) SIGINT", "9) SIGKILL", "15) SIGTERM"} {
+		if !strings.Contains(list, name) {
+			t.Errorf("kill -l: %q missing from %q", name, list)
+		}
+	}
+}
+
+func TestSourceMultiLineAlias(t *testing.T) {
+	rc := filepath.Join(t.TempDir(), "rc")
+	content := `# aliases for the test
+alias long="echo one \
+two" # the backslash joins the lines
+alias \
+  short='echo three'
+echo sourced # a comment after a command
+`
+	if err := os.WriteFile(rc, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := options.expandAliases
+	options.expandAliases = true
+	t.Cleanup(func() {
+		options.expandAliases = saved
+		delete(aliases, "long")
+		delete(aliases, "short")
+	})
+
+	s := NewShell()
+	if got, _ := run(t, s, "source "+rc); got != "sourced\n" {
+		t.Errorf("source: got %q, want %q", got, "sourced\n")
+	}
+
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"long", "one two\n"},
+		{"short four", "three four\n"},
+	}
+	for _, tt := range tests {
+		if got, _ := run(t, s, tt.line); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestSignalStatus(t *testing.T) {
+	s := NewShell()
+	run(t, s, "sleep 10 &", "kill -TERM %%")
+	if _, status := run(t, s, "wait %%"); status != 128+int(syscall.SIGTERM) {
+		t.Errorf("wait for a sleep killed by SIGTERM: status %d, want %d", status, 128+int(syscall.SIGTERM))
+	}
+
+	// A command killed by a signal is still reported, as bash does
+	_, _, status, err := s.Run(`sh -c 'kill -TERM $$'`)
+	if err == nil || status != 128+int(syscall.SIGTERM) {
+		t.Errorf("foreground command killed by SIGTERM: status %d, error %v; want %d and an error", status, err, 128+int(syscall.SIGTERM))
+	}
+	if got, _ := run(t, s, "echo $?"); got != "143\n" {
+		t.Errorf("$? after SIGTERM: got %q, want %q", got, "143\n")
+	}
+
+	if _, status := run(t, s, `sh -c 'exit 3'`); status != 3 {
+		t.Errorf("exit 3: status %d, want 3", status)
+	}
+}
+
+// feedLines returns a nextLine function that reads from lines, to give a
+// command run with Run the here-document bodies that would follow it.
+func feedLines(lines ...string) func() (string, bool) {
+	return func() (string, bool) {
+		if len(lines) == 0 {
+			return "", false
+		}
+		line := lines[0]
+		lines = lines[1:]
+		return line, true
+	}
+}
+
+func TestHereDocWithRedirect(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.txt")
+	tests := []struct {
+		line string
+		body []string
+		want string
+	}{
+		{"cat <<EOF >" + out, []string{"one", "two", "EOF"}, "one\ntwo\n"},
+		{"cat <<EOF >>" + out, []string{"three", "EOF"}, "one\ntwo\nthree\n"},
+		{"cat >" + out + " <<'EOF'", []string{"$HOME", "EOF"}, "$HOME\n"},
+		{"cat <<EOF | tr a-z A-Z >" + out, []string{"piped", "EOF"}, "PIPED\n"},
+	}
+
+	s := NewShell()
+	for _, tt := range tests {
+		s.nextLine = feedLines(tt.body...)
+		if got, _ := run(t, s, tt.line); got != "" {
+			t.Errorf("%s: wrote %q to stdout, want nothing", tt.line, got)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s: file has %q, want %q", tt.line, data, tt.want)
+		}
+	}
+}
+
+func TestAdjacentQuotes(t *testing.T) {
+	t.Setenv("HOME", "/home/u")
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`printf '<%s>' foo"bar baz"qux`, "<foobar bazqux>"},
+		{`printf '<%s>' 'a'"b"c`, "<abc>"},
+		{`printf '<%s>' a'$HOME'"$HOME"x`, "<a$HOME/home/ux>"},
+		{`printf '<%s>' "x"'y'z""`, "<xyz>"},
+		{`printf '<%s>' a\ b c`, "<a b><c>"},
+		{`printf '<%s>' "" ''`, "<><>"},
+		{`printf '<%s>' 'it'\''s'`, "<it's>"},
+	}
+
+	s := NewShell()
+	for _, tt := range tests {
+		if got, _ := run(t, s, tt.line); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestPipelineSubshell(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewShell()
+	t.Cleanup(func() {
+		os.Chdir(dir)
+		delete(shellVars, "x")
+		os.Unsetenv("PIPE_X")
+	})
+
+	run(t, s, "cd /tmp | cat", "x=1 | cat", "export PIPE_X=1 | cat")
+	if got, _ := os.Getwd(); got != dir {
+		t.Errorf("cd in a pipeline moved the shell to %s", got)
+	}
+	if _, ok := findVar("x"); ok {
+		t.Error("an assignment in a pipeline set x in the shell")
+	}
+	if _, ok := os.LookupEnv("PIPE_X"); ok {
+		t.Error("export in a pipeline set PIPE_X in the shell")
+	}
+	if got, _ := run(t, s, "x=2", "declare -p x | cat"); !strings.Contains(got, "x=") || !strings.Contains(got, "2") {
+		t.Errorf("a pipeline builtin got %q, want the shell's variables", got)
+	}
+}
+
+func TestCommandSubst(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewShell()
+	t.Cleanup(func() {
+		os.Chdir(dir)
+		delete(shellVars, "v")
+		delete(shellVars, "x")
+	})
+
+	if got, _ := run(t, s, `v=$(printf 'a\nb\n')`, `printf '%s' "$v"`); got != "a\nb" {
+		t.Errorf("got %q, want %q", got, "a\nb")
+	}
+	if got, _ := run(t, s, "x=1", "v=$(x=2; cd /; echo $x)", `echo "$v $x"`); got != "2 1\n" {
+		t.Errorf("got %q, want the substitution's own x", got)
+	}
+	if got, _ := os.Getwd(); got != dir {
+		t.Errorf("cd in a command substitution moved the shell to %s", got)
+	}
+	if _, status := run(t, s, "v=$(exit 3)"); status != 3 {
+		t.Errorf("status %d, want 3", status)
+	}
+}
+
+func TestDeclarePrint(t *testing.T) {
+	s := NewShell()
+	t.Cleanup(func() {
+		delete(arrayVars, "da")
+		delete(arrayVars, "db")
+	})
+
+	if got, _ := run(t, s, "declare -a da", "declare -p da"); got != "declare -a da=()\n" {
+		t.Errorf("empty array: got %q", got)
+	}
+	if got, _ := run(t, s, `db=(1 "two 2" "it's")`, "declare -p db"); got != `declare -a db=([0]=1 [1]='two 2' [2]='it'\''s')`+"\n" {
+		t.Errorf("array: got %q", got)
+	}
+}
+
+func TestExecFD(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "log")
+	s := NewShell()
+	run(t, s, "exec 3>"+log, "echo hi >&3", "exec 3>&-")
+	if _, ok := s.extraFDs[3]; ok {
+		t.Error("descriptor 3 is still open")
+	}
+	if data, err := os.ReadFile(log); err != nil || string(data) != "hi\n" {
+		t.Errorf("log holds %q (%v), want %q", data, err, "hi\n")
+	}
+	if _, stderr, _, err := s.Run("echo again >&3"); err == nil && stderr == "" {
+		t.Error("writing to descriptor 3 after closing it succeeded")
+	}
+}
+
+func TestExportExpandsOnce(t *testing.T) {
+	s := NewShell()
+	t.Setenv("EXPORT_A", "a")
+
+	run(t, s, "export EXPORT_A=$EXPORT_A:x", "export EXPORT_A=$EXPORT_A:x")
+	if got := os.Getenv("EXPORT_A"); got != "a:x:x" {
+		t.Errorf("got %q, want %q", got, "a:x:x")
+	}
+	run(t, s, "export EXPORT_A='$EXPORT_A'")
+	if got := os.Getenv("EXPORT_A"); got != "$EXPORT_A" {
+		t.Errorf("got %q, want it literal", got)
+	}
+}
+
+func TestAliasExpansion(t *testing.T) {
+	saved := options.expandAliases
+	options.expandAliases = true
+	t.Cleanup(func() {
+		options.expandAliases = saved
+		for _, name := range []string{"ta", "tb", "tp", "tx", "ty"} {
+			delete(aliases, name)
+		}
+	})
+
+	s := NewShell()
+	run(t, s, "alias ta=tb", "alias tb='echo hi'", "alias tp='echo x y'", "alias tx=ty ty=tx")
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"ta", "hi\n"},
+		{"ta there", "hi there\n"},
+		{"tp | wc -w", "2\n"},
+		{"echo a | ta", "hi\n"},
+	}
+	for _, tt := range tests {
+		if got, _ := run(t, s, tt.line); strings.TrimLeft(got, " ") != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+
+	// Aliases naming each other stop at the first one seen again
+	if _, _, _, err := s.Run("tx"); exitStatus(err) != 127 || !strings.Contains(err.Error(), "tx") {
+		t.Errorf("tx: %v; want tx not found", err)
+	}
+}
+
+func TestAliasTrailingBlank(t *testing.T) {
+	saved := options.expandAliases
+	options.expandAliases = true
+	t.Cleanup(func() {
+		options.expandAliases = saved
+		for _, name := range []string{"ts", "ts2", "tll"} {
+			delete(aliases, name)
+		}
+	})
+
+	// echo stands in for sudo, showing the words it would be given
+	s := NewShell()
+	run(t, s, "alias ts='echo '", "alias ts2=ts", "alias tll='ls -l'")
+	for _, line := range []string{"ts tll", "ts tll | cat", "ts2 tll", "ts2 tll | cat"} {
+		if got, _ := run(t, s, line); got != "ls -l\n" {
+			t.Errorf("%s: got %q, want %q", line, got, "ls -l\n")
+		}
+	}
+}
+
+func TestQuoteContinuation(t *testing.T) {
+	s := NewShell()
+	if got, _ := run(t, s, "echo \"a\\\nb\" c\\\nd"); got != "ab cd\n" {
+		t.Errorf("got %q, want %q", got, "ab cd\n")
+	}
+	if got, _ := run(t, s, "echo 'a\\\nb'"); got != "a\\\nb\n" {
+		t.Errorf("single quotes: got %q, want the backslash and newline kept", got)
+	}
+
+	_, _, status, err := s.Run(`echo "open`)
+	if err == nil || status != 2 {
+		t.Errorf("unterminated quote: status %d, err %v; want a syntax error with status 2", status, err)
+	}
+}
+
+func TestRepeatLine(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	s := NewShell()
+	if got, _ := run(t, s, "repeat 2 echo a b '|' tr a-z A-Z"); got != "A B\nA B\n" {
+		t.Errorf("pipeline: got %q", got)
+	}
+	run(t, s, "repeat 3 echo x '>>' "+out)
+	if data, err := os.ReadFile(out); err != nil || string(data) != "x\nx\nx\n" {
+		t.Errorf("redirection: file holds %q (%v)", data, err)
+	}
+	if _, status := run(t, s, "repeat 2 false"); status != 1 {
+		t.Errorf("status %d, want 1", status)
+	}
+}
+
+func TestCoprocClosed(t *testing.T) {
+	s := NewShell()
+	t.Cleanup(func() {
+		unsetVar("TCP")
+		unsetVar("TCP_PID")
+	})
+
+	run(t, s, "coproc TCP true", "wait $TCP_PID")
+	run(t, s, "true")
+	if _, ok := findVar("TCP_PID"); ok {
+		t.Error("TCP_PID is still set")
+	}
+	if _, ok := arrayVars["TCP"]; ok {
+		t.Error("TCP is still set")
+	}
+	if len(s.extraFDs) != 0 {
+		t.Errorf("descriptors %v are still open", s.extraFDs)
+	}
+}
+
+func TestUlimitOutOfRange(t *testing.T) {
+	s := NewShell()
+	_, _, status, err := s.Run("ulimit -f 36028797018963968")
+	if err == nil || !strings.Contains(err.Error(), "out of range") || status != 1 {
+		t.Errorf("status %d, err %v; want limit out of range", status, err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// handleMapfile implements `mapfile [-t] [-n count] [name]`, also run as
+// readarray, which reads the lines of standard input into the indexed
+// array name, MAPFILE by default. -t removes the trailing newline from each
+// line and -n stops after count lines (0 means all).
+func (s *Shell) handleMapfile(args []string) error {
+	trim := false
+	limit := 0
+	name := "MAPFILE"
+
+	rest := args[1:]
+	for len(rest) > 0 && strings.HasPrefix(rest[0], "-") && rest[0] != "-" {
+		switch rest[0] {
+		case "-t":
+			trim = true
+		case "-n":
+			if len(rest) < 2 {
+				return usageError(args[0], "-n: option requires an argument")
+			}
+			n, err := strconv.Atoi(rest[1])
+			if err != nil || n < 0 {
+				return usageError(args[0], rest[1]+": invalid line count")
+			}
+			limit = n
+			rest = rest[1:]
+		default:
+			return invalidOption(args[0], rest[0])
+		}
+		rest = rest[1:]
+	}
+	if len(rest) > 1 {
+		return usageError(args[0], "")
+	}
+	if len(rest) == 1 {
+		name = rest[0]
+	}
+	if !isValidName(name) {
+		return fmt.Errorf("%s: `%s': not a valid identifier", args[0], name)
+	}
+
+	reader := bufio.NewReader(s.Stdin)
+	var lines []string
+	for limit == 0 || len(lines) < limit {
+		line, err := reader.ReadString('\n')
+		if line == "" && err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+		if trim {
+			line = strings.TrimSuffix(line, "\n")
+		}
+		lines = append(lines, line)
+	}
+
+	setArray(name, lines)
+	return nil
+}
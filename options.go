@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// shellOptions holds the behaviour toggles that can be changed at run time.
+// `set -o` controls the POSIX-style options and `shopt` the rest, as in
+// bash.
+type shellOptions struct {
+	cdspell bool
+	autocd  bool
+	correct bool
+
+	// cdFile lets cd take a file, going to the directory it is in.
+	cdFile bool
+
+	// expandAliases is on by default in an interactive shell and off in
+	// scripts and other non-interactive use, as in bash.
+	expandAliases bool
+
+	// pager shows long output of builtins such as history through $PAGER
+	// in an interactive shell.
+	pager bool
+
+	// xpgEcho makes echo interpret backslash escapes without -e.
+	xpgEcho bool
+
+	// histAppend adds each session's commands to the history file
+	// instead of replacing it.
+	histAppend bool
+
+	// saveDirs keeps the directory stack of an interactive shell from
+	// one session to the next.
+	saveDirs bool
+
+	// errexit stops a script or sourced file at the first line that
+	// fails.
+	errexit bool
+
+	nocaseglob bool
+	dotglob    bool
+	globstar   bool
+	nullglob   bool
+	failglob   bool
+}
+
+var options shellOptions
+
+// setOptions maps the names accepted by `set -o` to the fields they toggle.
+var setOptions = map[string]*bool{
+	"errexit": &options.errexit,
+}
+
+// shoptOptions maps the names accepted by shopt to the fields they toggle.
+var shoptOptions = map[string]*bool{
+	"cdspell": &options.cdspell,
+	"autocd":  &options.autocd,
+	"correct": &options.correct,
+	"cdfile":  &options.cdFile,
+
+	"expand_aliases": &options.expandAliases,
+	"pager":          &options.pager,
+	"xpg_echo":       &options.xpgEcho,
+	"savedirs":       &options.saveDirs,
+	"histappend":     &options.histAppend,
+
+	"nocaseglob": &options.nocaseglob,
+	"dotglob":    &options.dotglob,
+	"globstar":   &options.globstar,
+	"nullglob":   &options.nullglob,
+	"failglob":   &options.failglob,
+}
+
+// printOptions lists each option in table with its state.
+func printOptions(w io.Writer, table map[string]*bool) {
+	names := make([]string, 0, len(table))
+	for name := range table {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "%-15s\t%s\n", name, onOff(*table[name]))
+	}
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// handleSet implements `set -o name` and `set +o name` to enable and
+// disable options; `set -o` alone lists them. -e and +e are short for
+// errexit. The words after the options, or after --, become the positional
+// parameters.
+func (s *Shell) handleSet(args []string) error {
+	if len(args) == 1 || (len(args) == 2 && args[1] == "-o") {
+		printOptions(s.Stdout, setOptions)
+		return nil
+	}
+
+	for i := 1; i < len(args); i++ {
+		flag := args[i]
+		if flag == "--" || flag == "" || flag[0] != '-' && flag[0] != '+' {
+			if flag == "--" {
+				i++
+			}
+			s.params = append([]string(nil), args[i:]...)
+			return nil
+		}
+		if flag == "-e" || flag == "+e" {
+			options.errexit = flag == "-e"
+			continue
+		}
+		if flag != "-o" && flag != "+o" {
+			return invalidOption("set", flag)
+		}
+		if i+1 >= len(args) {
+			return usageError("set", flag+": option name required")
+		}
+		i++
+
+		opt, ok := setOptions[args[i]]
+		if !ok {
+			return usageError("set", args[i]+": invalid option name")
+		}
+		*opt = flag == "-o"
+	}
+
+	return nil
+}
+
+// handleShopt implements `shopt -s name...` and `shopt -u name...` to
+// enable and disable options. Without -s or -u it prints the named options,
+// or all of them, failing if any named option is off; -q suppresses the
+// output.
+func (s *Shell) handleShopt(args []string) error {
+	enable, disable, quiet := false, false, false
+	names := args[1:]
+	for len(names) > 0 && len(names[0]) > 1 && names[0][0] == '-' {
+		for _, c := range names[0][1:] {
+			switch c {
+			case 's':
+				enable = true
+			case 'u':
+				disable = true
+			case 'q':
+				quiet = true
+			default:
+				return invalidOption("shopt", "-"+string(c))
+			}
+		}
+		names = names[1:]
+	}
+	if enable && disable {
+		return usageError("shopt", "cannot set and unset options simultaneously")
+	}
+
+	for _, name := range names {
+		if _, ok := shoptOptions[name]; !ok {
+			return fmt.Errorf("shopt: %s: invalid shell option name", name)
+		}
+	}
+
+	if enable || disable {
+		if len(names) == 0 {
+			return usageError("shopt", "")
+		}
+		for _, name := range names {
+			*shoptOptions[name] = enable
+		}
+		return nil
+	}
+
+	if len(names) == 0 {
+		if !quiet {
+			printOptions(s.Stdout, shoptOptions)
+		}
+		return nil
+	}
+
+	allOn := true
+	for _, name := range names {
+		on := *shoptOptions[name]
+		allOn = allOn && on
+		if !quiet {
+			fmt.Fprintf(s.Stdout, "%-15s\t%s\n", name, onOff(on))
+		}
+	}
+	if !allOn {
+		return silentStatus(1)
+	}
+
+	return nil
+}
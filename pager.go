@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// pagedBuiltins are the builtins whose output can run to many screens,
+// and goes through a pager when the pager option is on.
+var pagedBuiltins = map[string]bool{
+	"history": true,
+	"help":    true,
+	"alias":   true,
+	"declare": true,
+}
+
+// runPaged runs a builtin with its output collected, then shows the
+// output through the pager if it is longer than the terminal.
+func (s *Shell) runPaged(handler func(*Shell, []string) error, args []string) error {
+	var out bytes.Buffer
+	origOut := s.Stdout
+	s.Stdout = &out
+	err := handler(s, args)
+	s.Stdout = origOut
+
+	page(out.Bytes())
+	return err
+}
+
+// shouldPage reports whether the output of the builtin name is to go
+// through the pager: the option is on, the shell is interactive, and the
+// output is going straight to the terminal.
+func (s *Shell) shouldPage(name string) bool {
+	return options.pager && s.interactive && pagedBuiltins[name] &&
+		s.Stdout == os.Stdout && isTerminal(int(os.Stdout.Fd()))
+}
+
+// page writes out to the terminal through $PAGER, or less, if it would not
+// fit on one screen, taken to be 24 lines if the terminal does not say.
+// Without a pager it is written directly.
+func page(out []byte) {
+	rows := terminalRows(int(os.Stdout.Fd()))
+	if rows == 0 {
+		rows = 24
+	}
+	if bytes.Count(out, []byte("\n")) < rows {
+		os.Stdout.Write(out)
+		return
+	}
+
+	pager := strings.Fields(os.Getenv("PAGER"))
+	if len(pager) == 0 {
+		pager = []string{"less"}
+	}
+	path, err := exec.LookPath(pager[0])
+	if err != nil {
+		os.Stdout.Write(out)
+		return
+	}
+
+	cmd := exec.Command(path, pager[1:]...)
+	cmd.Stdin = bytes.NewReader(out)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = foregroundAttr(0)
+	defer setForeground(shellPgid)
+	if err := cmd.Start(); err != nil {
+		os.Stdout.Write(out)
+		return
+	}
+	cmd.Wait()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// positional returns the value of the special parameter name if it is one
+// of the positional parameters: $1 and up, $# their count, and $@ and $*
+// all of them joined into one string. ok is false for any other name.
+func (s *Shell) positional(name string) (value string, ok bool) {
+	switch name {
+	case "#":
+		return strconv.Itoa(len(s.params)), true
+	case "@":
+		return strings.Join(s.params, " "), true
+	case "*":
+		return ifsJoin(s.params), true
+	}
+
+	n, err := strconv.Atoi(name)
+	if err != nil || n < 1 || name[0] == '+' {
+		return "", false
+	}
+	if n > len(s.params) {
+		return "", true
+	}
+	return s.params[n-1], true
+}
+
+// ifsJoin joins words with the first character of $IFS, or a space if
+// IFS is unset, as "$*" and "${a[*]}" do. An empty IFS joins them with
+// nothing between.
+func ifsJoin(words []string) string {
+	ifs, ok := findVar("IFS")
+	if !ok {
+		ifs = " "
+	}
+	sep := ""
+	for _, r := range ifs {
+		sep = string(r)
+		break
+	}
+	return strings.Join(words, sep)
+}
+
+// handleShift drops the first n positional parameters, one by default,
+// renumbering the rest from $1.
+func (s *Shell) handleShift(args []string) error {
+	if len(args) > 2 {
+		return usageError("shift", "too many arguments")
+	}
+
+	n := 1
+	if len(args) == 2 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n < 0 {
+			return usageError("shift", args[1]+": numeric argument required")
+		}
+	}
+	if n > len(s.params) {
+		return fmt.Errorf("shift: %d: shift count out of range", n)
+	}
+
+	s.params = s.params[n:]
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	pathCacheMu  sync.Mutex
+	pathCacheKey string
+	pathCache    []string
+)
+
+// pathExecutables returns the sorted, de-duplicated names of the
+// executables in the directories on PATH. The list is cached until PATH
+// changes.
+func pathExecutables() []string {
+	pathCacheMu.Lock()
+	defer pathCacheMu.Unlock()
+
+	path := os.Getenv("PATH")
+	if pathCache != nil && path == pathCacheKey {
+		return pathCache
+	}
+
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if seen[entry.Name()] {
+				continue
+			}
+			if !isExecutable(filepath.Join(dir, entry.Name())) {
+				continue
+			}
+			seen[entry.Name()] = true
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	pathCacheKey, pathCache = path, names
+	return names
+}
+
+// isExecutable reports whether path is something that can be run as a
+// command: a regular file, after following symlinks, with an execute bit
+// set. Directories and other files on PATH are not commands.
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0
+}
+
+// pathLookupAll returns every executable called name in the directories on
+// PATH, in the order they are searched. A name with a slash in it is not
+// searched for, and is returned only if it is executable itself.
+func pathLookupAll(name string) []string {
+	if strings.Contains(name, "/") {
+		if isExecutable(name) {
+			return []string{name}
+		}
+		return nil
+	}
+
+	var paths []string
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		if path := filepath.Join(dir, name); isExecutable(path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// handleType says how each name would be run as a command: as an alias, a
+// builtin or a program on PATH, in that order. With -a it lists every one
+// of those that applies, rather than only the one that is used.
+func (s *Shell) handleType(args []string) error {
+	all := false
+	names := args[1:]
+	for len(names) > 0 && strings.HasPrefix(names[0], "-") && names[0] != "-" {
+		opt := names[0]
+		names = names[1:]
+		if opt == "--" {
+			break
+		}
+		for _, c := range opt[1:] {
+			if c != 'a' {
+				return invalidOption("type", "-"+string(c))
+			}
+			all = true
+		}
+	}
+	if len(names) == 0 {
+		return usageError("type", "")
+	}
+
+	failed := false
+	for _, name := range names {
+		var found []string
+		if value, ok := aliases[name]; ok {
+			found = append(found, fmt.Sprintf("%s is aliased to `%s'", name, value))
+		}
+		if _, ok := builtins[name]; ok {
+			found = append(found, name+" is a shell builtin")
+		}
+		if len(found) == 0 || all {
+			for _, path := range pathLookupAll(name) {
+				found = append(found, name+" is "+path)
+				if !all {
+					break
+				}
+			}
+		}
+
+		if len(found) == 0 {
+			fmt.Fprintf(s.Stderr, "type: %s: not found\n", name)
+			failed = true
+			continue
+		}
+		if !all {
+			found = found[:1]
+		}
+		for _, line := range found {
+			fmt.Fprintln(s.Stdout, line)
+		}
+	}
+
+	if failed {
+		return silentStatus(1)
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// expandEscapes interprets the backslash escapes of echo -e, printf %b and
+// printf formats: \a \b \e \f \n \r \t \v \\, \xHH, \uHHHH, \UHHHHHHHH and
+// octal. Octal is \0nnn for echo and %b, and \nnn in a printf format,
+// which is what format selects. \c ends the output there, which stop
+// reports. Any other backslash is kept as it is.
+func expandEscapes(s string, format bool) (out string, stop bool) {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'c':
+			return b.String(), true
+		case 'e', 'E':
+			b.WriteByte(0x1b)
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case '\\':
+			b.WriteByte('\\')
+		case 'x', 'u', 'U':
+			max := map[byte]int{'x': 2, 'u': 4, 'U': 8}[c]
+			n, value := digits(s[i+1:], 16, max)
+			if n == 0 {
+				b.WriteByte('\\')
+				b.WriteByte(c)
+				continue
+			}
+			if c == 'x' {
+				b.WriteByte(byte(value))
+			} else {
+				b.WriteRune(rune(value))
+			}
+			i += n
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			if !format && c != '0' {
+				b.WriteByte('\\')
+				b.WriteByte(c)
+				continue
+			}
+			start := i
+			if !format {
+				start++
+			}
+			n, value := digits(s[start:], 8, 3)
+			b.WriteByte(byte(value))
+			i = start + n - 1
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String(), false
+}
+
+// digits reads up to max digits in base from the start of s, returning
+// how many it read and their value.
+func digits(s string, base, max int) (int, int) {
+	n, value := 0, 0
+	for n < len(s) && n < max {
+		d, err := strconv.ParseUint(s[n:n+1], base, 8)
+		if err != nil {
+			break
+		}
+		value = value*base + int(d)
+		n++
+	}
+	return n, value
+}
+
+// handleEcho prints its arguments separated by spaces. -n leaves off the
+// newline, -e interprets backslash escapes and -E does not. Escapes are
+// off by default, or on with shopt -s xpg_echo; either way the last of
+// -e and -E given wins.
+func (s *Shell) handleEcho(args []string) error {
+	newline, escapes := true, options.xpgEcho
+	words := args[1:]
+	for len(words) > 0 && isEchoFlag(words[0]) {
+		for _, c := range words[0][1:] {
+			switch c {
+			case 'n':
+				newline = false
+			case 'e':
+				escapes = true
+			case 'E':
+				escapes = false
+			}
+		}
+		words = words[1:]
+	}
+
+	out := strings.Join(words, " ")
+	if escapes {
+		var stop bool
+		if out, stop = expandEscapes(out, false); stop {
+			newline = false
+		}
+	}
+	if newline {
+		out += "\n"
+	}
+	fmt.Fprint(s.Stdout, out)
+	return nil
+}
+
+// isEchoFlag reports whether arg is an echo option, made up only of the
+// letters n, e and E; anything else is printed.
+func isEchoFlag(arg string) bool {
+	if len(arg) < 2 || arg[0] != '-' {
+		return false
+	}
+	return strings.Trim(arg[1:], "neE") == ""
+}
+
+// handlePrintf writes its arguments under the control of a format, as
+// printf(1) does. The format is reused until the arguments run out. With
+// -v name the result is assigned to the variable or array element name
+// instead of being printed.
+func (s *Shell) handlePrintf(args []string) error {
+	varName := ""
+	if len(args) > 1 && args[1] == "-v" {
+		if len(args) < 3 {
+			return usageError("printf", "-v: option requires an argument")
+		}
+		varName = args[2]
+		if _, _, ok := splitSubscript(varName); !ok && !isValidName(varName) {
+			return fmt.Errorf("printf: `%s': not a valid identifier", varName)
+		}
+		args = append(args[:1:1], args[3:]...)
+	}
+	if len(args) < 2 {
+		return usageError("printf", "")
+	}
+
+	out, err := formatPrintf(args[1], args[2:])
+	if varName == "" {
+		fmt.Fprint(s.Stdout, out)
+	} else if name, sub, ok := splitSubscript(varName); ok {
+		if setErr := setElement(name, sub, out); setErr != nil {
+			return fmt.Errorf("printf: %w", setErr)
+		}
+	} else {
+		setVar(varName, out)
+	}
+	if err != nil {
+		fmt.Fprintf(s.Stderr, "printf: %v\n", err)
+		return silentStatus(1)
+	}
+	return nil
+}
+
+// formatPrintf formats args with format, as printf does. A bad argument
+// is reported after the output is complete, with 0 used in its place.
+func formatPrintf(format string, args []string) (string, error) {
+	var b strings.Builder
+	var result error
+
+	for {
+		used := 0
+		next := func() (string, bool) {
+			if used >= len(args) {
+				return "", false
+			}
+			used++
+			return args[used-1], true
+		}
+
+		for i := 0; i < len(format); i++ {
+			c := format[i]
+			if c == '\\' {
+				end := i + 1
+				if end < len(format) {
+					end++
+					// Take in the digits of an escape with any
+					for end < len(format) && end < i+10 && isEscapeDigit(format[i+1], format[end]) {
+						end++
+					}
+				}
+				text, stop := expandEscapes(format[i:end], true)
+				b.WriteString(text)
+				if stop {
+					return b.String(), result
+				}
+				i = end - 1
+				continue
+			}
+			if c != '%' {
+				b.WriteByte(c)
+				continue
+			}
+
+			// A conversion: %[flags][width][.precision]verb
+			start := i
+			i++
+			for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+				i++
+			}
+			for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+				i++
+			}
+			if i < len(format) && format[i] == '.' {
+				i++
+				for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+					i++
+				}
+			}
+			if i == len(format) {
+				return b.String(), fmt.Errorf("%s: missing format character", format[start:])
+			}
+			spec, verb := format[start:i], format[i]
+
+			if verb == '%' {
+				b.WriteByte('%')
+				continue
+			}
+			arg, _ := next()
+			switch verb {
+			case 's':
+				fmt.Fprintf(&b, spec+"s", arg)
+			case 'q':
+				fmt.Fprintf(&b, spec+"s", shellQuote(arg))
+			case 'b':
+				text, stop := expandEscapes(arg, false)
+				fmt.Fprintf(&b, spec+"s", text)
+				if stop {
+					return b.String(), result
+				}
+			case 'c':
+				r, _ := utf8.DecodeRuneInString(arg)
+				if arg != "" {
+					fmt.Fprintf(&b, spec+"c", r)
+				}
+			case 'd', 'i':
+				n, err := printfInt(arg)
+				if err != nil && result == nil {
+					result = err
+				}
+				fmt.Fprintf(&b, spec+"d", n)
+			case 'u', 'o', 'x', 'X':
+				n, err := printfInt(arg)
+				if err != nil && result == nil {
+					result = err
+				}
+				if verb == 'u' {
+					verb = 'd'
+				}
+				fmt.Fprintf(&b, spec+string(verb), uint64(n))
+			case 'f', 'F', 'e', 'E', 'g', 'G':
+				f, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+				if err != nil && arg != "" {
+					if n, intErr := printfInt(arg); intErr == nil {
+						f = float64(n)
+					} else if result == nil {
+						result = fmt.Errorf("%s: invalid number", arg)
+					}
+				}
+				fmt.Fprintf(&b, spec+string(verb), f)
+			default:
+				return b.String(), fmt.Errorf("%%%c: invalid format character", verb)
+			}
+		}
+
+		// The format is used again for arguments it did not take, but
+		// not if it took none at all
+		if used == 0 || used >= len(args) {
+			break
+		}
+		args = args[used:]
+	}
+
+	return b.String(), result
+}
+
+// isEscapeDigit reports whether c can continue the escape that starts
+// with \ and then kind in a printf format.
+func isEscapeDigit(kind, c byte) bool {
+	switch {
+	case kind >= '0' && kind <= '7':
+		return c >= '0' && c <= '7'
+	case kind == 'x' || kind == 'u' || kind == 'U':
+		_, err := strconv.ParseUint(string(c), 16, 8)
+		return err == nil
+	}
+	return false
+}
+
+// printfInt converts a printf numeric argument: decimal, 0x hex, 0 octal,
+// or a quote followed by a character for its code. "" is 0.
+func printfInt(arg string) (int64, error) {
+	if arg == "" {
+		return 0, nil
+	}
+	if arg[0] == '\'' || arg[0] == '"' {
+		r, _ := utf8.DecodeRuneInString(arg[1:])
+		return int64(r), nil
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(arg), 0, 64)
+	if err != nil {
+		var numErr *strconv.NumError
+		if errors.As(err, &numErr) && numErr.Err == strconv.ErrRange {
+			return n, fmt.Errorf("%s: result too large", arg)
+		}
+		return 0, fmt.Errorf("%s: invalid number", arg)
+	}
+	return n, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// shellQuote returns word as it would have to be written on a command line
+// to reach a command unchanged: as is if it has no special characters,
+// otherwise in single quotes.
+func shellQuote(word string) string {
+	if word == "" {
+		return "''"
+	}
+	safe := true
+	for _, r := range word {
+		if !isSafeRune(r) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+// isSafeRune reports whether r means nothing special to the shell in any
+// position of an unquoted word.
+func isSafeRune(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		strings.ContainsRune("_-+=/.,:@%", r)
+}
+
+// quoteWords joins words into a command line that splits back into them.
+func quoteWords(words []string) string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = shellQuote(word)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// quoteAssign quotes the value of a NAME=value or NAME[sub]=value word,
+// leaving the name to be recognized as an assignment.
+func quoteAssign(word string) string {
+	name, value, ok := strings.Cut(word, "=")
+	if !ok {
+		return shellQuote(word)
+	}
+	return name + "=" + shellQuote(value)
+}
+
+// String renders the command, after expansion, as a command line that
+// runs it again with the same words and redirections: for traces, debug
+// logs and the jobs table. A here-document follows on the lines after the
+// command, ended by a delimiter that does not occur in it.
+func (c *simpleCommand) String() string {
+	var words []string
+	for _, assign := range c.assigns {
+		words = append(words, quoteAssign(assign))
+	}
+	for _, array := range c.arrays {
+		values := make([]string, len(array.values))
+		for i, value := range array.values {
+			if key, elem, ok := strings.Cut(value, "]="); ok && strings.HasPrefix(key, "[") {
+				values[i] = "[" + shellQuote(key[1:]) + "]=" + shellQuote(elem)
+			} else {
+				values[i] = shellQuote(value)
+			}
+		}
+		words = append(words, array.name+"=("+strings.Join(values, " ")+")")
+	}
+	if len(c.args) > 0 {
+		// A command name with = in it must not read as an assignment
+		name := shellQuote(c.args[0])
+		if name == c.args[0] && strings.Contains(name, "=") {
+			name = "'" + name + "'"
+		}
+		words = append(words, name)
+		if len(c.args) > 1 {
+			words = append(words, quoteWords(c.args[1:]))
+		}
+	}
+
+	var docs []string
+	for _, r := range c.redirs {
+		// The descriptor is left out where it is the default for the
+		// operator
+		fd := strconv.Itoa(r.fd)
+		if r.fd == 0 && r.op[0] == '<' || r.fd == 1 && r.op[0] == '>' {
+			fd = ""
+		}
+		switch r.op {
+		case "<<":
+			delim := "EOF"
+			for strings.Contains("\n"+r.target, "\n"+delim+"\n") {
+				delim += "_"
+			}
+			words = append(words, fd+"<<'"+delim+"'")
+			docs = append(docs, r.target+delim)
+		case "<&", ">&":
+			words = append(words, fd+r.op+r.target)
+		default:
+			words = append(words, fd+r.op+" "+shellQuote(r.target))
+		}
+	}
+
+	line := strings.Join(words, " ")
+	for _, doc := range docs {
+		line += "\n" + doc
+	}
+	return line
+}
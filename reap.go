@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// children maps each running job process to its job, for reapChildren.
+// It is guarded by jobsMutex.
+var children = make(map[int]*Job)
+
+var reaperOnce sync.Once
+
+// startReaping hands the processes of a started job to the SIGCHLD
+// handler, which collects their status as they stop, continue and exit.
+// Once they have all exited, reaped is closed, and if finish is set the
+// job finishes with the status of its last process. Otherwise the caller
+// finishes it after waiting for reaped and anything else the job runs.
+func startReaping(job *Job, finish bool) {
+	reaperOnce.Do(func() {
+		sigchld := make(chan os.Signal, 1)
+		signal.Notify(sigchld, syscall.SIGCHLD)
+		go func() {
+			for range sigchld {
+				reapChildren()
+			}
+		}()
+	})
+
+	jobsMutex.Lock()
+	job.finishOnReap = finish
+	job.pending = len(job.cmds)
+	for _, cmd := range job.cmds {
+		children[cmd.Process.Pid] = job
+	}
+	jobsMutex.Unlock()
+
+	if len(job.cmds) == 0 {
+		go job.release()
+		return
+	}
+	// A process that ended before it was registered has already had its
+	// SIGCHLD
+	reapChildren()
+}
+
+// reapChildren collects every status change of the job processes without
+// blocking. Only the registered processes are waited for, so commands the
+// shell runs and waits for itself are left alone.
+func reapChildren() {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	for pid, job := range children {
+		for {
+			var ws syscall.WaitStatus
+			var usage syscall.Rusage
+			got, err := syscall.Wait4(pid, &ws, syscall.WNOHANG|syscall.WUNTRACED|syscall.WCONTINUED, &usage)
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			if err != nil {
+				// Someone else reaped it; its status is lost
+				delete(children, pid)
+				job.exited(pid, syscall.WaitStatus(0))
+				break
+			}
+			if got != pid {
+				break
+			}
+
+			if ws.Stopped() {
+				job.Stopped = true
+				if jobs[job.ID] == job {
+					makeCurrent(job)
+				}
+				select {
+				case job.stopped <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			if ws.Continued() {
+				job.Stopped = false
+				continue
+			}
+			delete(children, pid)
+			job.user += time.Duration(usage.Utime.Nano())
+			job.sys += time.Duration(usage.Stime.Nano())
+			job.exited(pid, ws)
+			break
+		}
+	}
+}
+
+// exited records that the job process pid has ended with ws. When it is the
+// last of the job's processes, the job is released. The caller holds
+// jobsMutex.
+func (j *Job) exited(pid int, ws syscall.WaitStatus) {
+	if pid == j.PID && (ws.Exited() && ws.ExitStatus() != 0 || ws.Signaled()) {
+		j.procErr = &waitError{ws}
+	}
+	j.pending--
+	if j.pending == 0 {
+		go j.release()
+	}
+}
+
+// release finishes with the job's processes once they have all been
+// reaped. Calling Wait on them no longer reaps anything, but waits for
+// the copying of any of their input and output that is not a file, so a
+// command substitution has all of the output, and closes the pipes.
+func (j *Job) release() {
+	for _, cmd := range j.cmds {
+		cmd.Wait()
+	}
+	close(j.reaped)
+	if j.finishOnReap {
+		j.finish(j.procErr)
+	}
+}
+
+// waitError is the failure of a process that exited with a nonzero status
+// or was killed by a signal.
+type waitError struct {
+	status syscall.WaitStatus
+}
+
+func (e *waitError) Error() string {
+	if e.status.Signaled() {
+		return "signal: " + e.status.Signal().String()
+	}
+	return fmt.Sprintf("exit status %d", e.status.ExitStatus())
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// redirection is one redirection of a command. fd is the descriptor it
+// changes, and op says how: < opens target to read, > and >> to write, <<
+// reads the here-document text in target, and <& and >& make fd a copy of
+// descriptor target, or close it if target is "-".
+type redirection struct {
+	fd     int
+	op     string
+	target string
+}
+
+// fdTable is the set of descriptors a command runs with: the standard
+// three, and the higher ones opened with exec or for the command itself.
+type fdTable struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	extra  map[int]*os.File
+}
+
+// closedFD stands in for a standard descriptor closed with N>&-. Reading
+// and writing fail as they would on a closed descriptor.
+type closedFD struct{}
+
+func (closedFD) Read([]byte) (int, error)  { return 0, syscall.EBADF }
+func (closedFD) Write([]byte) (int, error) { return 0, syscall.EBADF }
+
+// fds returns the descriptors of the shell itself.
+func (s *Shell) fds() fdTable {
+	return fdTable{stdin: s.Stdin, stdout: s.Stdout, stderr: s.Stderr, extra: s.extraFDs}
+}
+
+// apply performs redirections in order on a copy of the table. It returns
+// the new table and the files it opened, which the caller closes once the
+// command is done with them.
+func (t fdTable) apply(redirs []redirection) (fdTable, []*os.File, error) {
+	t.extra = maps.Clone(t.extra)
+	var opened []*os.File
+	fail := func(err error) (fdTable, []*os.File, error) {
+		closeFiles(opened)
+		return fdTable{}, nil, err
+	}
+
+	for _, r := range redirs {
+		var err error
+		switch r.op {
+		case "<<":
+			if r.fd != 0 {
+				return fail(fmt.Errorf("%d: here-documents can only be read on standard input", r.fd))
+			}
+			t.stdin = strings.NewReader(r.target)
+		case "<", ">", ">>":
+			var file *os.File
+			if r.op == "<" {
+				file, err = os.Open(r.target)
+			} else {
+				file, err = openOutputFile(r.target, r.op == ">>")
+			}
+			if err != nil {
+				return fail(err)
+			}
+			opened = append(opened, file)
+			err = t.set(r.fd, file)
+		case "<&", ">&":
+			if r.target == "-" {
+				t.close(r.fd)
+				continue
+			}
+			n, convErr := strconv.Atoi(r.target)
+			src := t.get(n)
+			if convErr != nil || src == nil {
+				return fail(fmt.Errorf("%s: bad file descriptor", r.target))
+			}
+			err = t.set(r.fd, src)
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	return t, opened, nil
+}
+
+// isNumber reports whether word is a descriptor number: all digits.
+func isNumber(word string) bool {
+	if word == "" {
+		return false
+	}
+	for _, r := range word {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// get returns what descriptor fd refers to, or nil if it is not open.
+func (t fdTable) get(fd int) any {
+	switch fd {
+	case 0:
+		if t.stdin != nil {
+			return t.stdin
+		}
+	case 1:
+		if t.stdout != nil {
+			return t.stdout
+		}
+	case 2:
+		if t.stderr != nil {
+			return t.stderr
+		}
+	default:
+		if file, ok := t.extra[fd]; ok {
+			return file
+		}
+	}
+	return nil
+}
+
+// set makes descriptor fd refer to v. Descriptors above 2 can only be
+// files, as they are passed to commands as they are.
+func (t *fdTable) set(fd int, v any) error {
+	bad := fmt.Errorf("%d: bad file descriptor", fd)
+	switch fd {
+	case 0:
+		r, ok := v.(io.Reader)
+		if !ok {
+			return bad
+		}
+		t.stdin = r
+	case 1, 2:
+		w, ok := v.(io.Writer)
+		if !ok {
+			return bad
+		}
+		if fd == 1 {
+			t.stdout = w
+		} else {
+			t.stderr = w
+		}
+	default:
+		file, ok := v.(*os.File)
+		if !ok {
+			return fmt.Errorf("%d: cannot redirect to a descriptor that is not a file", fd)
+		}
+		t.extra = setFD(t.extra, fd, file)
+	}
+	return nil
+}
+
+// close closes descriptor fd for the command.
+func (t *fdTable) close(fd int) {
+	switch fd {
+	case 0:
+		t.stdin = closedFD{}
+	case 1:
+		t.stdout = closedFD{}
+	case 2:
+		t.stderr = closedFD{}
+	default:
+		delete(t.extra, fd)
+	}
+}
+
+// setup gives an external command the descriptors of the table. Higher
+// descriptors go in ExtraFiles, where entry i becomes descriptor 3+i.
+func (t fdTable) setup(cmd *exec.Cmd) {
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = forExec(t.stdin), forExec(t.stdout), forExec(t.stderr)
+
+	top := 2
+	for fd := range t.extra {
+		top = max(top, fd)
+	}
+	cmd.ExtraFiles = nil
+	if top > 2 {
+		cmd.ExtraFiles = make([]*os.File, top-2)
+		for fd, file := range t.extra {
+			cmd.ExtraFiles[fd-3] = file
+		}
+	}
+}
+
+// forExec returns a standard descriptor as exec.Cmd takes it: a closed
+// one becomes nil, which exec connects to /dev/null.
+func forExec[T any](v T) T {
+	if _, ok := any(v).(closedFD); ok {
+		var zero T
+		return zero
+	}
+	return v
+}
+
+// closeFiles closes files opened for a command's redirections.
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// redirectShell applies the redirections of exec without a command to the
+// shell itself, so that they last for the commands after it.
+func (s *Shell) redirectShell(redirs []redirection) error {
+	table, _, err := s.fds().apply(redirs)
+	if err != nil {
+		return fmt.Errorf("exec: %w", err)
+	}
+
+	// Descriptors replaced or closed by the redirections are closed for
+	// good, unless they are still in use under another number. The
+	// process's own standard files stay open for the shell's prompts.
+	inUse := map[any]bool{table.stdin: true, table.stdout: true, table.stderr: true}
+	for _, file := range table.extra {
+		inUse[file] = true
+	}
+	replaced := []any{s.Stdin, s.Stdout, s.Stderr}
+	for _, file := range s.extraFDs {
+		replaced = append(replaced, file)
+	}
+	for _, v := range replaced {
+		file, ok := v.(*os.File)
+		if ok && !inUse[file] && file != os.Stdin && file != os.Stdout && file != os.Stderr {
+			file.Close()
+		}
+	}
+
+	s.Stdin, s.Stdout, s.Stderr, s.extraFDs = table.stdin, table.stdout, table.stderr, table.extra
+	return nil
+}
+
+// handleExec replaces the shell with a command. Its redirections have
+// already been applied to the shell's descriptors, which the command is
+// given as they are. In a sub-shell, such as a pipeline stage, only that
+// sub-shell is replaced, so the command is simply run.
+func (s *Shell) handleExec(args []string) error {
+	if len(args) < 2 {
+		return nil
+	}
+	if s.subshell {
+		return s.execExternal(args[1:], &simpleCommand{}, false)
+	}
+
+	path, err := exec.LookPath(args[1])
+	if err != nil {
+		return notFoundError(args[1])
+	}
+
+	table := s.fds()
+	fds := map[int]any{0: table.stdin, 1: table.stdout, 2: table.stderr}
+	for fd, file := range table.extra {
+		fds[fd] = file
+	}
+	moved, err := moveFDs(fds)
+	if err != nil {
+		return fmt.Errorf("exec: %w", err)
+	}
+
+	if s.interactive {
+		saveHistory()
+		saveDirs()
+	}
+	err = syscall.Exec(path, args[1:], os.Environ())
+	moved.restore()
+	return fmt.Errorf("exec: %s: %w", args[1], err)
+}
+
+// movedFDs records the descriptors moveFDs replaced, to put them back.
+type movedFDs struct {
+	saved map[int]savedFD
+}
+
+// savedFD is a copy of what a descriptor was and its close-on-exec flag.
+// fd is -1 for a descriptor that was not open.
+type savedFD struct {
+	fd      int
+	cloexec bool
+}
+
+// moveFDs makes each descriptor in fds, in increasing order, refer to its
+// file, or closes it for a closedFD. The files are first copied out of
+// the way, so that one descriptor being replaced does not change what
+// another is to become. What the descriptors were is saved, close on
+// exec, so restore can put it back, as the Go runtime has descriptors of
+// its own among them.
+func moveFDs(fds map[int]any) (*movedFDs, error) {
+	order := slices.Sorted(maps.Keys(fds))
+	moved := &movedFDs{saved: make(map[int]savedFD)}
+	staged := make(map[int]int)
+	defer func() {
+		for _, fd := range staged {
+			syscall.Close(fd)
+		}
+	}()
+
+	for _, fd := range order {
+		if _, ok := fds[fd].(closedFD); ok {
+			continue
+		}
+		file, ok := fds[fd].(*os.File)
+		if !ok {
+			return nil, fmt.Errorf("%d: cannot pass on a descriptor that is not a file", fd)
+		}
+		if int(file.Fd()) == fd {
+			continue
+		}
+		copied, err := dupHigh(int(file.Fd()))
+		if err != nil {
+			return nil, fmt.Errorf("%d: %w", fd, err)
+		}
+		staged[fd] = copied
+	}
+
+	for _, fd := range order {
+		copied, replace := staged[fd]
+		_, closing := fds[fd].(closedFD)
+		if !replace && !closing {
+			continue
+		}
+		saved := savedFD{fd: -1}
+		if flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0); errno == 0 {
+			saved.cloexec = flags&syscall.FD_CLOEXEC != 0
+			var err error
+			if saved.fd, err = dupHigh(fd); err != nil {
+				moved.restore()
+				return nil, fmt.Errorf("%d: %w", fd, err)
+			}
+		}
+		moved.saved[fd] = saved
+		if closing {
+			syscall.Close(fd)
+		} else if err := syscall.Dup3(copied, fd, 0); err != nil {
+			moved.restore()
+			return nil, fmt.Errorf("%d: %w", fd, err)
+		}
+	}
+	return moved, nil
+}
+
+// restore puts back the descriptors moveFDs replaced.
+func (m *movedFDs) restore() {
+	for fd, saved := range m.saved {
+		if saved.fd < 0 {
+			syscall.Close(fd)
+			continue
+		}
+		flags := 0
+		if saved.cloexec {
+			flags = syscall.O_CLOEXEC
+		}
+		syscall.Dup3(saved.fd, fd, flags)
+		syscall.Close(saved.fd)
+	}
+}
+
+// dupHigh copies descriptor fd to a new one, close on exec, above those
+// a command's redirections use.
+func dupHigh(fd int) (int, error) {
+	copied, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_DUPFD_CLOEXEC, 100)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(copied), nil
+}
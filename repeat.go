@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// handleRepeat runs a command count times, taking on the status of the
+// last run. The words of the command are joined into a line, so it can
+// have redirections and pipes of its own. An interrupt stops it early.
+func (s *Shell) handleRepeat(args []string) error {
+	if len(args) < 3 {
+		return usageError("repeat", "")
+	}
+	count, err := strconv.Atoi(args[1])
+	if err != nil || count < 0 {
+		return usageError("repeat", args[1]+": invalid count")
+	}
+
+	interrupted, stop := catchInterrupts()
+	defer stop()
+
+	line := strings.Join(args[2:], " ")
+	status := 0
+	for i := 0; i < count; i++ {
+		select {
+		case <-interrupted:
+			return silentStatus(interruptStatus)
+		default:
+		}
+		err := s.execInput(line)
+		if s.wasInterrupted(err) {
+			return err
+		}
+		if err != nil {
+			s.reportError(err)
+		}
+		status = s.lastStatus
+	}
+	if status != 0 {
+		return silentStatus(status)
+	}
+	return nil
+}
+
+// defaultWatchInterval is how long watch waits between runs without -n.
+const defaultWatchInterval = 2 * time.Second
+
+// handleWatch runs a command over and over, every two seconds or every
+// -n seconds, clearing the screen before each run, until it is
+// interrupted with Ctrl+C. The interrupt stops watch, not the shell. As
+// with repeat, the words of the command are joined into a line.
+func (s *Shell) handleWatch(args []string) error {
+	interval := defaultWatchInterval
+	words := args[1:]
+	if len(words) > 0 && words[0] == "-n" {
+		if len(words) < 2 {
+			return usageError("watch", "-n: option requires an argument")
+		}
+		secs, err := strconv.ParseFloat(words[1], 64)
+		if err != nil || secs <= 0 {
+			return usageError("watch", words[1]+": invalid interval")
+		}
+		interval = time.Duration(secs * float64(time.Second))
+		words = words[2:]
+	}
+	if len(words) == 0 {
+		return usageError("watch", "")
+	}
+
+	interrupted, stop := catchInterrupts()
+	defer stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		fmt.Fprint(s.Stdout, "\033[H\033[2J")
+		fmt.Fprintf(s.Stdout, "Every %gs: %s\t%s\n\n", interval.Seconds(), quoteWords(words), time.Now().Format(time.ANSIC))
+		err := s.execInput(strings.Join(words, " "))
+		if s.wasInterrupted(err) {
+			return nil
+		}
+		if err != nil {
+			s.reportError(err)
+		}
+
+		select {
+		case <-interrupted:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// interruptStatus is the status of a command stopped by SIGINT.
+const interruptStatus = 128 + int(syscall.SIGINT)
+
+// wasInterrupted reports whether the command that returned err was
+// stopped by SIGINT, which under job control reaches the command and not
+// the shell: it was killed by the signal, or exited or failed with the
+// status that stands for it, as a repeat stopped early does.
+func (s *Shell) wasInterrupted(err error) bool {
+	var waitErr *waitError
+	if errors.As(err, &waitErr) && waitErr.status.Signaled() {
+		return waitErr.status.Signal() == syscall.SIGINT
+	}
+	return s.lastStatus == interruptStatus
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// signals lists the signals known by name, without the SIG prefix, in
+// the order kill -l shows them.
+var signals = []struct {
+	name string
+	sig  syscall.Signal
+}{
+	{"HUP", syscall.SIGHUP},
+	{"INT", syscall.SIGINT},
+	{"QUIT", syscall.SIGQUIT},
+	{"ILL", syscall.SIGILL},
+	{"TRAP", syscall.SIGTRAP},
+	{"ABRT", syscall.SIGABRT},
+	{"BUS", syscall.SIGBUS},
+	{"FPE", syscall.SIGFPE},
+	{"KILL", syscall.SIGKILL},
+	{"USR1", syscall.SIGUSR1},
+	{"SEGV", syscall.SIGSEGV},
+	{"USR2", syscall.SIGUSR2},
+	{"PIPE", syscall.SIGPIPE},
+	{"ALRM", syscall.SIGALRM},
+	{"TERM", syscall.SIGTERM},
+	{"CHLD", syscall.SIGCHLD},
+	{"CONT", syscall.SIGCONT},
+	{"STOP", syscall.SIGSTOP},
+	{"TSTP", syscall.SIGTSTP},
+	{"TTIN", syscall.SIGTTIN},
+	{"TTOU", syscall.SIGTTOU},
+	{"URG", syscall.SIGURG},
+	{"XCPU", syscall.SIGXCPU},
+	{"XFSZ", syscall.SIGXFSZ},
+	{"VTALRM", syscall.SIGVTALRM},
+	{"PROF", syscall.SIGPROF},
+	{"WINCH", syscall.SIGWINCH},
+	{"IO", syscall.SIGIO},
+	{"SYS", syscall.SIGSYS},
+}
+
+// signalByName returns the signal named by spec: a name such as INT, with
+// or without the SIG prefix and in any case, or a number.
+func signalByName(spec string) (syscall.Signal, bool) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n < 0 || n > 64 {
+			return 0, false
+		}
+		return syscall.Signal(n), true
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(spec), "SIG")
+	for _, s := range signals {
+		if s.name == name {
+			return s.sig, true
+		}
+	}
+	return 0, false
+}
+
+// nameBySignal returns the name of sig without the SIG prefix, or "" if
+// it has none.
+func nameBySignal(sig syscall.Signal) string {
+	for _, s := range signals {
+		if s.sig == sig {
+			return s.name
+		}
+	}
+	return ""
+}
+
+// listSignals writes the signal table as kill -l shows it: each number
+// and name, several to a line.
+func listSignals(w io.Writer) {
+	for i, s := range signals {
+		if i%5 == 4 || i == len(signals)-1 {
+			fmt.Fprintf(w, "%2d) SIG%s\n", int(s.sig), s.name)
+		} else {
+			fmt.Fprintf(w, "%2d) SIG%-7s\t", int(s.sig), s.name)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// spellCorrectDir fixes small typos in a directory path the way bash's
+// cdspell does. Each component that does not exist is replaced by the one
+// subdirectory of its parent a single typo away from it; if there is no
+// such subdirectory, or more than one, no correction is made.
+func spellCorrectDir(dir string) (string, bool) {
+	cur := ""
+	if filepath.IsAbs(dir) {
+		cur = string(filepath.Separator)
+	}
+
+	corrected := false
+	for _, part := range strings.Split(filepath.Clean(dir), string(filepath.Separator)) {
+		if part == "" {
+			continue
+		}
+
+		next := filepath.Join(cur, part)
+		if _, err := os.Stat(next); err == nil {
+			cur = next
+			continue
+		}
+
+		parent := cur
+		if parent == "" {
+			parent = "."
+		}
+		entries, err := os.ReadDir(parent)
+		if err != nil {
+			return "", false
+		}
+
+		match := ""
+		for _, entry := range entries {
+			if !oneTypoApart(part, entry.Name()) {
+				continue
+			}
+			if info, err := os.Stat(filepath.Join(parent, entry.Name())); err != nil || !info.IsDir() {
+				continue
+			}
+			if match != "" {
+				return "", false
+			}
+			match = entry.Name()
+		}
+		if match == "" {
+			return "", false
+		}
+
+		cur = filepath.Join(cur, match)
+		corrected = true
+	}
+
+	return cur, corrected
+}
+
+// oneTypoApart reports whether typed differs from name by two swapped
+// adjacent characters, one missing character or one extra character.
+func oneTypoApart(typed, name string) bool {
+	t, n := []rune(typed), []rune(name)
+
+	switch len(n) - len(t) {
+	case 0:
+		i := 0
+		for i < len(t) && t[i] == n[i] {
+			i++
+		}
+		return i+1 < len(t) && t[i] == n[i+1] && t[i+1] == n[i] &&
+			string(t[i+2:]) == string(n[i+2:])
+	case 1:
+		return dropsToEqual(n, t)
+	case -1:
+		return dropsToEqual(t, n)
+	}
+
+	return false
+}
+
+// dropsToEqual reports whether removing one rune from long yields short.
+func dropsToEqual(long, short []rune) bool {
+	i := 0
+	for i < len(short) && long[i] == short[i] {
+		i++
+	}
+	return string(long[i+1:]) == string(short[i:])
+}
+
+// maxSuggestions caps how many alternatives a command-not-found error
+// offers.
+const maxSuggestions = 3
+
+// suggestCommands returns the builtins, aliases and PATH executables whose
+// names are within a small edit distance of name, closest first.
+func suggestCommands(name string) []string {
+	maxDist := 2
+	if n := len([]rune(name)); n <= 3 {
+		maxDist = 1
+	}
+
+	dists := make(map[string]int)
+	consider := func(candidate string) {
+		if candidate == name {
+			return
+		}
+		if _, seen := dists[candidate]; seen {
+			return
+		}
+		if d := editDistance(name, candidate); d <= maxDist {
+			dists[candidate] = d
+		}
+	}
+
+	for candidate := range builtins {
+		consider(candidate)
+	}
+	for candidate := range aliases {
+		consider(candidate)
+	}
+	for _, candidate := range pathExecutables() {
+		consider(candidate)
+	}
+
+	matches := make([]string, 0, len(dists))
+	for candidate := range dists {
+		matches = append(matches, candidate)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if dists[matches[i]] != dists[matches[j]] {
+			return dists[matches[i]] < dists[matches[j]]
+		}
+		return matches[i] < matches[j]
+	})
+
+	if len(matches) > maxSuggestions {
+		matches = matches[:maxSuggestions]
+	}
+	return matches
+}
+
+// correctionFor returns the command name is most likely a typo of, if
+// one suggestion is strictly closer than all the others.
+func correctionFor(name string) (string, bool) {
+	suggestions := suggestCommands(name)
+	if len(suggestions) == 0 {
+		return "", false
+	}
+	if len(suggestions) > 1 && editDistance(name, suggestions[0]) == editDistance(name, suggestions[1]) {
+		return "", false
+	}
+	return suggestions[0], true
+}
+
+// editDistance returns the Levenshtein distance between a and b, counting
+// a swap of two adjacent runes as a single edit since that is the most
+// common typo.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	rows := make([][]int, len(ra)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(rb)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			rows[i][j] = min(rows[i-1][j]+1, rows[i][j-1]+1, rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				rows[i][j] = min(rows[i][j], rows[i-2][j-2]+1)
+			}
+		}
+	}
+
+	return rows[len(ra)][len(rb)]
+}
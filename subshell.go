@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// subshellEnv is set in the environment of the shell started as a
+// subshell, to the descriptor it reads its state from.
+const subshellEnv = "GOSH_SUBSHELL_FD"
+
+// subshellState is what a subshell starts from: a copy of the state of
+// the shell that started it, and the command to run.
+type subshellState struct {
+	// Args is a builtin to run with its words already expanded, and Line
+	// the command line to run when there is no builtin.
+	Args []string
+	Line string
+
+	Vars     map[string]string
+	Arrays   map[string][]string
+	Assocs   map[string]map[string]string
+	Aliases  map[string]string
+	Options  map[string]bool
+	DirStack []string
+	History  []string
+
+	Params        []string
+	LastStatus    int
+	LastArg       string
+	ScriptName    string
+	ScriptLine    int
+	Interactive   bool
+	ActiveAliases map[string]bool
+
+	// ExtraFDs are the descriptors above 2 the subshell is given.
+	ExtraFDs []int
+
+	Jobs        []subshellJob
+	CurrentJob  int
+	PreviousJob int
+	JobCounter  int
+}
+
+// subshellJob is a job of the shell that started a subshell. The
+// subshell can list it and signal it, but not wait for it.
+type subshellJob struct {
+	ID       int
+	PID      int
+	PIDs     []int
+	Pgid     int
+	Command  string
+	Stopped  bool
+	Finished bool
+	Status   syscall.WaitStatus
+}
+
+// newSubshell returns a command that runs the shell itself as a subshell
+// of s, as bash forks one, for pipeline builtins and command
+// substitutions: args as a builtin or, if there are none, line. It has
+// the descriptors of fds, and whatever it changes, variables and working
+// directory included, is its own. Its state is sent through the returned
+// file, which the caller closes once the command has started.
+func (s *Shell) newSubshell(fds fdTable, args []string, line string) (*exec.Cmd, *os.File, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := json.Marshal(s.subshellState(fds, args, line))
+	if err != nil {
+		return nil, nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd := exec.Command(exe)
+	fds.setup(cmd)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", subshellEnv, 2+len(cmd.ExtraFiles)))
+
+	// The state may be more than the pipe holds, so it is written as the
+	// subshell reads it. If the subshell never starts, closing the read
+	// end makes the write fail.
+	go func() {
+		w.Write(data)
+		w.Close()
+	}()
+	return cmd, r, nil
+}
+
+// subshellState copies the state of s for a subshell that runs args or
+// line with the descriptors of fds.
+func (s *Shell) subshellState(fds fdTable, args []string, line string) *subshellState {
+	state := &subshellState{
+		Args:          args,
+		Line:          line,
+		Vars:          shellVars,
+		Arrays:        arrayVars,
+		Assocs:        assocVars,
+		Aliases:       aliases,
+		Options:       make(map[string]bool),
+		DirStack:      dirStack,
+		History:       history,
+		Params:        s.params,
+		LastStatus:    s.lastStatus,
+		LastArg:       s.lastArg,
+		ScriptName:    s.scriptName,
+		ScriptLine:    s.scriptLine,
+		Interactive:   s.interactive,
+		ActiveAliases: s.activeAliases,
+	}
+	for _, table := range []map[string]*bool{setOptions, shoptOptions} {
+		for name, opt := range table {
+			state.Options[name] = *opt
+		}
+	}
+	for fd := range fds.extra {
+		state.ExtraFDs = append(state.ExtraFDs, fd)
+	}
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	state.CurrentJob, state.PreviousJob, state.JobCounter = currentJob, previousJob, jobCounter
+	for _, id := range sortedJobIDs() {
+		job := jobs[id]
+		sj := subshellJob{
+			ID:       job.ID,
+			PID:      job.PID,
+			PIDs:     job.PIDs,
+			Pgid:     job.Pgid,
+			Command:  job.Command,
+			Stopped:  job.Stopped,
+			Finished: job.finished(),
+		}
+		if sj.Finished {
+			var waitErr *waitError
+			if errors.As(job.err, &waitErr) {
+				sj.Status = waitErr.status
+			} else {
+				sj.Status = syscall.WaitStatus(exitStatus(job.err) & 0xff << 8)
+			}
+		}
+		state.Jobs = append(state.Jobs, sj)
+	}
+	return state
+}
+
+// runSubshell runs the process as a subshell, started by newSubshell with
+// its state on descriptor fd, and exits with the status of its command.
+func runSubshell(fd string) {
+	os.Unsetenv(subshellEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: bad descriptor %q\n", subshellEnv, fd)
+		os.Exit(2)
+	}
+	file := os.NewFile(uintptr(n), "subshell state")
+	var state subshellState
+	err = json.NewDecoder(file).Decode(&state)
+	file.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "subshell:", err)
+		os.Exit(2)
+	}
+
+	s := NewShell()
+	state.restore(s)
+	if state.Args != nil {
+		err = builtins[state.Args[0]](s, state.Args)
+		s.lastStatus = exitStatus(err)
+	} else {
+		err = s.execInput(state.Line)
+	}
+	if err != nil {
+		s.reportError(err)
+	}
+	s.exit(s.lastStatus)
+}
+
+// restore gives the subshell s the state it was started with.
+func (state *subshellState) restore(s *Shell) {
+	shellVars, arrayVars, assocVars = state.Vars, state.Arrays, state.Assocs
+	aliases = state.Aliases
+	dirStack, history = state.DirStack, state.History
+	// A nil map decodes from null, but has to take assignments
+	for _, m := range []*map[string]string{&shellVars, &aliases} {
+		if *m == nil {
+			*m = make(map[string]string)
+		}
+	}
+	if arrayVars == nil {
+		arrayVars = make(map[string][]string)
+	}
+	if assocVars == nil {
+		assocVars = make(map[string]map[string]string)
+	}
+	for _, table := range []map[string]*bool{setOptions, shoptOptions} {
+		for name, opt := range table {
+			*opt = state.Options[name]
+		}
+	}
+
+	s.subshell = true
+	s.params = state.Params
+	s.lastStatus, s.lastArg = state.LastStatus, state.LastArg
+	s.scriptName, s.scriptLine = state.ScriptName, state.ScriptLine
+	s.interactive = state.Interactive
+	s.activeAliases = maps.Clone(state.ActiveAliases)
+	for _, fd := range state.ExtraFDs {
+		s.extraFDs = setFD(s.extraFDs, fd, os.NewFile(uintptr(fd), "fd "+strconv.Itoa(fd)))
+	}
+
+	currentJob, previousJob, jobCounter = state.CurrentJob, state.PreviousJob, state.JobCounter
+	for _, sj := range state.Jobs {
+		job := &Job{
+			ID:        sj.ID,
+			PID:       sj.PID,
+			PIDs:      sj.PIDs,
+			Pgid:      sj.Pgid,
+			Command:   sj.Command,
+			Stopped:   sj.Stopped,
+			done:      make(chan struct{}),
+			stopped:   make(chan struct{}, 1),
+			reaped:    make(chan struct{}),
+			inherited: true,
+		}
+		if sj.Finished {
+			var err error
+			if sj.Status != 0 {
+				err = &waitError{sj.Status}
+			}
+			job.finish(err)
+		}
+		jobs[job.ID] = job
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// ttyFd is the terminal an interactive shell shares with its foreground
+// jobs, or -1 when there is no job control. shellPgid is the shell's own
+// process group, which gets the terminal back after each job.
+var (
+	ttyFd     = -1
+	shellPgid int
+)
+
+// initJobControl turns on job control if standard input is a terminal.
+func initJobControl() {
+	if !isTerminal(0) {
+		return
+	}
+	ttyFd = 0
+	shellPgid = syscall.Getpgrp()
+}
+
+func isTerminal(fd int) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
+
+// foregroundAttr returns the process attributes that start a foreground
+// command in the process group pgid, or in a new group that gets the
+// terminal if pgid is 0. Without job control it returns nil, and the
+// command shares the shell's group.
+func foregroundAttr(pgid int) *syscall.SysProcAttr {
+	if ttyFd < 0 {
+		return nil
+	}
+	if pgid != 0 {
+		return &syscall.SysProcAttr{Setpgid: true, Pgid: pgid}
+	}
+	return &syscall.SysProcAttr{Foreground: true, Ctty: ttyFd}
+}
+
+// setForeground gives the terminal to the process group pgid. A shell
+// that is not itself in the foreground would be stopped by SIGTTOU for
+// this, so the signal is ignored for the duration.
+func setForeground(pgid int) {
+	if ttyFd < 0 {
+		return
+	}
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+
+	pg := int32(pgid)
+	syscall.Syscall(syscall.SYS_IOCTL, uintptr(ttyFd), syscall.TIOCSPGRP, uintptr(unsafe.Pointer(&pg)))
+}
+
+// terminalRows returns the height of the terminal on fd, or 0 if fd is not
+// a terminal.
+func terminalRows(fd int) int {
+	var size struct{ rows, cols, xpixel, ypixel uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0
+	}
+	return int(size.rows)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"strings"
+)
+
+// expandTilde returns the directory a tilde prefix, the text between ~ and
+// the first slash, stands for: ~ is $HOME, ~+ is $PWD, ~- is $OLDPWD and
+// ~user is that user's home directory. ok is false for any other prefix,
+// or one whose directory is not known, which is then left as it is.
+func expandTilde(prefix string) (dir string, ok bool) {
+	switch prefix {
+	case "":
+		if home := lookupVar("HOME"); home != "" {
+			return home, true
+		}
+		home, err := os.UserHomeDir()
+		return home, err == nil
+	case "+":
+		dir = os.Getenv("PWD")
+	case "-":
+		dir = os.Getenv("OLDPWD")
+	default:
+		u, err := user.Lookup(prefix)
+		if err != nil {
+			return "", false
+		}
+		dir = u.HomeDir
+	}
+	return dir, dir != ""
+}
+
+// isTildeRune reports whether r can be part of a tilde prefix: a user
+// name, or the + and - of ~+ and ~-.
+func isTildeRune(r rune) bool {
+	return isNameChar(r) || strings.ContainsRune(".-+", r)
+}
+
+// abbreviateHome writes dir with $HOME at its start as ~, as dirs and the
+// prompt show it.
+func abbreviateHome(dir string) string {
+	home, ok := expandTilde("")
+	if !ok || home == "/" {
+		return dir
+	}
+	home = strings.TrimSuffix(home, "/")
+	if dir == home || strings.HasPrefix(dir, home+"/") {
+		return "~" + dir[len(home):]
+	}
+	return dir
+}
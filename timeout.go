@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// timeoutStatus is the status of a command that timeout had to stop, as
+// GNU timeout returns.
+const timeoutStatus = 124
+
+// defaultKillAfter is how long timeout waits after the first signal before
+// sending SIGKILL, unless -k says otherwise, so that a command that
+// ignores SIGTERM cannot hold up the shell for ever.
+const defaultKillAfter = 10 * time.Second
+
+// handleTimeout runs a command and signals it, SIGTERM by default or the
+// signal given with -s, if it is still running after a duration. It is
+// sent SIGKILL if it has still not finished ten seconds after that, or the
+// time given with -k; -k 0 never sends it. A command that timed out gives
+// the status 124.
+func (s *Shell) handleTimeout(args []string) error {
+	sig := syscall.SIGTERM
+	killAfter := defaultKillAfter
+	words := args[1:]
+	for len(words) > 0 && strings.HasPrefix(words[0], "-") && words[0] != "-" {
+		opt := words[0]
+		words = words[1:]
+		if opt == "--" {
+			break
+		}
+		if opt != "-s" && opt != "-k" {
+			return invalidOption("timeout", opt)
+		}
+		if len(words) == 0 {
+			return usageError("timeout", opt+": option requires an argument")
+		}
+		if opt == "-s" {
+			var ok bool
+			if sig, ok = signalByName(words[0]); !ok {
+				return usageError("timeout", words[0]+": invalid signal specification")
+			}
+		} else {
+			var err error
+			if killAfter, err = parseTimeout(words[0]); err != nil {
+				return usageError("timeout", words[0]+": invalid time interval")
+			}
+		}
+		words = words[1:]
+	}
+	if len(words) < 2 {
+		return usageError("timeout", "")
+	}
+	limit, err := parseTimeout(words[0])
+	if err != nil {
+		return usageError("timeout", words[0]+": invalid time interval")
+	}
+
+	if ttyFd >= 0 {
+		defer setForeground(shellPgid)
+	}
+	job, err := s.startExternal(words[1:], &simpleCommand{}, false)
+	if err != nil {
+		return err
+	}
+
+	// A duration of 0 never times out
+	timedOut := make(chan struct{})
+	if limit > 0 {
+		timer := time.AfterFunc(limit, func() {
+			close(timedOut)
+			signalJob(job, sig)
+			if killAfter > 0 {
+				time.AfterFunc(killAfter, func() { signalJob(job, syscall.SIGKILL) })
+			}
+		})
+		defer timer.Stop()
+	}
+
+	err = s.waitForeground(job)
+	select {
+	case <-timedOut:
+		return silentStatus(timeoutStatus)
+	default:
+		return err
+	}
+}
+
+// signalJob sends sig to a job that timed out, continuing it in case it is
+// stopped. Without job control it shares the shell's process group, so
+// only its process is signalled.
+func signalJob(job *Job, sig syscall.Signal) {
+	if job.finished() {
+		return
+	}
+	pid := job.PID
+	if job.Pgid != 0 {
+		pid = -job.Pgid
+	}
+	syscall.Kill(pid, sig)
+	syscall.Kill(pid, syscall.SIGCONT)
+}
+
+// parseTimeout parses a duration for timeout: a number of seconds, which
+// may have a fraction, or of minutes, hours or days with an m, h or d
+// after it.
+func parseTimeout(arg string) (time.Duration, error) {
+	unit := time.Second
+	switch {
+	case strings.HasSuffix(arg, "s"):
+		arg = arg[:len(arg)-1]
+	case strings.HasSuffix(arg, "m"):
+		unit, arg = time.Minute, arg[:len(arg)-1]
+	case strings.HasSuffix(arg, "h"):
+		unit, arg = time.Hour, arg[:len(arg)-1]
+	case strings.HasSuffix(arg, "d"):
+		unit, arg = 24*time.Hour, arg[:len(arg)-1]
+	}
+	n, err := strconv.ParseFloat(arg, 64)
+	if err != nil || n < 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return time.Duration(n * float64(unit)), nil
+}
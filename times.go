@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// handleTimes prints the user and system CPU time used by the shell, then
+// by the children it has waited for, as POSIX times does.
+func (s *Shell) handleTimes(args []string) error {
+	for _, who := range []int{syscall.RUSAGE_SELF, syscall.RUSAGE_CHILDREN} {
+		var usage syscall.Rusage
+		if err := syscall.Getrusage(who, &usage); err != nil {
+			return fmt.Errorf("times: %w", err)
+		}
+		fmt.Fprintf(s.Stdout, "%s %s\n", formatCPUTime(usage.Utime), formatCPUTime(usage.Stime))
+	}
+	return nil
+}
+
+// formatCPUTime formats a CPU time as minutes and seconds, like 0m0.004s.
+func formatCPUTime(tv syscall.Timeval) string {
+	d := time.Duration(tv.Nano())
+	minutes := int(d / time.Minute)
+	seconds := (d % time.Minute).Seconds()
+	return fmt.Sprintf("%dm%.3fs", minutes, seconds)
+}
+
+// defaultTimeFormat is what time prints when TIMEFORMAT is unset.
+const defaultTimeFormat = "\nreal\t%3lR\nuser\t%3lU\nsys\t%3lS"
+
+// posixTimeFormat is what time -p prints.
+const posixTimeFormat = "real %2R\nuser %2U\nsys %2S"
+
+// waitedUser and waitedSys add up the CPU time of the processes of the
+// foreground jobs the shell has waited for, so that time charges a
+// pipeline with its own processes and not background jobs that happen to
+// end while it runs. They are guarded by jobsMutex.
+var waitedUser, waitedSys time.Duration
+
+// timing is a point to measure a timed pipeline from: the wall clock, and
+// the CPU time of the shell and its foreground jobs so far.
+type timing struct {
+	start     time.Time
+	user, sys time.Duration
+}
+
+// startTiming starts timing a pipeline.
+func startTiming() timing {
+	user, sys := cpuTimes()
+	return timing{start: time.Now(), user: user, sys: sys}
+}
+
+// cpuTimes returns the user and system CPU time used by the shell and the
+// foreground jobs it has waited for, together.
+func cpuTimes() (user, sys time.Duration) {
+	var usage syscall.Rusage
+	if syscall.Getrusage(syscall.RUSAGE_SELF, &usage) == nil {
+		user = time.Duration(usage.Utime.Nano())
+		sys = time.Duration(usage.Stime.Nano())
+	}
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	return user + waitedUser, sys + waitedSys
+}
+
+// reportTime prints how long a timed pipeline took since t, in the format
+// of $TIMEFORMAT, or the POSIX one for time -p. An empty TIMEFORMAT
+// prints nothing.
+func (s *Shell) reportTime(t timing, posix bool) {
+	real := time.Since(t.start)
+	user, sys := cpuTimes()
+	user -= t.user
+	sys -= t.sys
+
+	format := posixTimeFormat
+	if !posix {
+		var ok bool
+		if format, ok = findVar("TIMEFORMAT"); !ok {
+			format = defaultTimeFormat
+		}
+	}
+	if format == "" {
+		return
+	}
+	fmt.Fprintln(s.Stderr, formatTime(format, real, user, sys))
+}
+
+// formatTime expands the escapes of a TIMEFORMAT: %R, %U and %S are the
+// real, user and system time in seconds and %P the CPU percentage. An
+// optional digit before the letter gives the number of decimal places, 3
+// at most, and an l the long form, such as 1m2.500s. %% is a percent sign.
+func formatTime(format string, real, user, sys time.Duration) string {
+	var b strings.Builder
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+		start := i
+		i++
+		if format[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+
+		precision, long := 3, false
+		if format[i] >= '0' && format[i] <= '9' {
+			precision = min(int(format[i]-'0'), 3)
+			i++
+		}
+		if i < len(format) && format[i] == 'l' {
+			long = true
+			i++
+		}
+		if i == len(format) {
+			b.WriteString(format[start:])
+			break
+		}
+
+		var d time.Duration
+		switch format[i] {
+		case 'R':
+			d = real
+		case 'U':
+			d = user
+		case 'S':
+			d = sys
+		case 'P':
+			percent := 0.0
+			if real > 0 {
+				percent = float64(user+sys) / float64(real) * 100
+			}
+			fmt.Fprintf(&b, "%.*f", precision, percent)
+			continue
+		default:
+			b.WriteString(format[start : i+1])
+			continue
+		}
+		if long {
+			fmt.Fprintf(&b, "%dm%.*fs", int(d/time.Minute), precision, (d % time.Minute).Seconds())
+		} else {
+			fmt.Fprintf(&b, "%.*f", precision, d.Seconds())
+		}
+	}
+
+	return b.String()
+}
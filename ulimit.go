@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"syscall"
+)
+
+// rlimitNproc is RLIMIT_NPROC, which the syscall package does not export.
+const rlimitNproc = 0x6
+
+// rlimInfinity is RLIM_INFINITY as the unsigned value Rlimit holds.
+const rlimInfinity = ^uint64(0)
+
+// ulimitResource describes a resource limit ulimit can query or set. Limits
+// are shown and given in multiples of unit bytes (or plain counts when unit
+// is 1), as bash does.
+type ulimitResource struct {
+	resource int
+	desc     string
+	unit     uint64
+}
+
+var ulimitResources = map[byte]ulimitResource{
+	'c': {syscall.RLIMIT_CORE, "core file size (blocks)", 512},
+	'd': {syscall.RLIMIT_DATA, "data seg size (kbytes)", 1024},
+	'f': {syscall.RLIMIT_FSIZE, "file size (blocks)", 512},
+	'n': {syscall.RLIMIT_NOFILE, "open files", 1},
+	's': {syscall.RLIMIT_STACK, "stack size (kbytes)", 1024},
+	't': {syscall.RLIMIT_CPU, "cpu time (seconds)", 1},
+	'u': {rlimitNproc, "max user processes", 1},
+	'v': {syscall.RLIMIT_AS, "virtual memory (kbytes)", 1024},
+}
+
+// handleUlimit shows or sets a resource limit of the shell, which children
+// started afterwards inherit. -H and -S select the hard or soft limit;
+// setting a value without either changes both.
+func (s *Shell) handleUlimit(args []string) error {
+	flag := byte('f')
+	hard, soft, all := false, false, false
+	var value string
+
+	for _, arg := range args[1:] {
+		if len(arg) < 2 || arg[0] != '-' {
+			if value != "" {
+				return usageError("ulimit", "")
+			}
+			value = arg
+			continue
+		}
+		for i := 1; i < len(arg); i++ {
+			switch c := arg[i]; c {
+			case 'H':
+				hard = true
+			case 'S':
+				soft = true
+			case 'a':
+				all = true
+			default:
+				if _, ok := ulimitResources[c]; !ok {
+					return invalidOption("ulimit", "-"+string(c))
+				}
+				flag = c
+			}
+		}
+	}
+
+	if all {
+		flags := make([]byte, 0, len(ulimitResources))
+		for c := range ulimitResources {
+			flags = append(flags, c)
+		}
+		sort.Slice(flags, func(i, j int) bool { return flags[i] < flags[j] })
+
+		for _, c := range flags {
+			res := ulimitResources[c]
+			var lim syscall.Rlimit
+			if err := syscall.Getrlimit(res.resource, &lim); err != nil {
+				return fmt.Errorf("ulimit: %s: %w", res.desc, err)
+			}
+			fmt.Fprintf(s.Stdout, "%-28s(-%c) %s\n", res.desc, c, formatRlimit(pickRlimit(lim, hard), res.unit))
+		}
+		return nil
+	}
+
+	res := ulimitResources[flag]
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(res.resource, &lim); err != nil {
+		return fmt.Errorf("ulimit: %s: %w", res.desc, err)
+	}
+
+	if value == "" {
+		fmt.Fprintln(s.Stdout, formatRlimit(pickRlimit(lim, hard), res.unit))
+		return nil
+	}
+
+	n := rlimInfinity
+	if value != "unlimited" {
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return usageError("ulimit", value+": invalid number")
+		}
+		if v > rlimInfinity/res.unit {
+			return fmt.Errorf("ulimit: %s: limit out of range", value)
+		}
+		n = v * res.unit
+	}
+
+	if hard || !soft {
+		lim.Max = n
+	}
+	if soft || !hard {
+		lim.Cur = n
+	}
+	if err := syscall.Setrlimit(res.resource, &lim); err != nil {
+		return fmt.Errorf("ulimit: %s: cannot modify limit: %w", res.desc, err)
+	}
+
+	return nil
+}
+
+func pickRlimit(lim syscall.Rlimit, hard bool) uint64 {
+	if hard {
+		return lim.Max
+	}
+	return lim.Cur
+}
+
+func formatRlimit(v, unit uint64) string {
+	if v == rlimInfinity {
+		return "unlimited"
+	}
+	return strconv.FormatUint(v/unit, 10)
+}
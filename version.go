@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// version is the release version, set at build time with
+// -ldflags "-X main.version=v1.2.3". Builds without it report the module
+// version from the build info, or "devel".
+var version = ""
+
+// versionInfo describes this build for --version and the version builtin:
+// the version, the Go toolchain, and the VCS revision when the build
+// recorded one.
+func versionInfo() string {
+	var b strings.Builder
+	v := version
+	var revision, built string
+	modified := false
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.time":
+				built = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+	}
+	if v == "" {
+		v = "devel"
+	}
+
+	fmt.Fprintf(&b, "shell-fs version %s\n", v)
+	fmt.Fprintf(&b, "go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	if revision != "" {
+		if modified {
+			revision += " (modified)"
+		}
+		fmt.Fprintf(&b, "revision: %s\n", revision)
+	}
+	if built != "" {
+		fmt.Fprintf(&b, "commit time: %s\n", built)
+	}
+
+	return b.String()
+}
+
+func (s *Shell) handleVersion(args []string) error {
+	fmt.Fprint(s.Stdout, versionInfo())
+	return nil
+}